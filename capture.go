@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MSP capture file format (text, one frame per line):
+//
+//	# impload capture 1
+//	<seconds since start> <TX|RX> <frame as hex>
+//
+// e.g.
+//
+//	0.000000 TX 244d3c000101
+//	0.012345 RX 244d3e030100020603
+//
+// Lines starting with '#' are comments. TX frames are sent by impload, RX
+// frames are complete frames (including any with CRC errors) from the FC.
+// In the CLI, TX and RX records are the text as sent and received.
+
+const capture_HEADER = "# impload capture 1"
+
+type Capture struct {
+	mu    sync.Mutex
+	w     io.WriteCloser
+	start time.Time
+}
+
+var capture *Capture
+
+func NewCapture(fn string) (*Capture, error) {
+	w, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(w, capture_HEADER)
+	fmt.Fprintf(w, "# %s %s\n", GetVersion(), time.Now().Format(time.RFC3339))
+	return &Capture{w: w, start: time.Now()}, nil
+}
+
+func (c *Capture) Log(dirn string, buf []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.w, "%.6f %s %s\n", time.Since(c.start).Seconds(), dirn, hex.EncodeToString(buf))
+}
+
+func (c *Capture) Close() {
+	if c != nil {
+		c.w.Close()
+	}
+}
+
+type CaptureRecord struct {
+	stamp float64
+	tx    bool
+	data  []byte
+}
+
+func Read_capture(fn string) ([]CaptureRecord, error) {
+	r, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	recs := []CaptureRecord{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lno := 0
+	for scanner.Scan() {
+		lno++
+		ln := strings.TrimSpace(scanner.Text())
+		if len(ln) == 0 || ln[0] == '#' {
+			continue
+		}
+		parts := strings.Fields(ln)
+		if len(parts) != 3 || (parts[1] != "TX" && parts[1] != "RX") {
+			return nil, fmt.Errorf("%s:%d: invalid capture record", fn, lno)
+		}
+		rec := CaptureRecord{tx: parts[1] == "TX"}
+		rec.stamp, _ = strconv.ParseFloat(parts[0], 64)
+		rec.data, err = hex.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fn, lno, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scanner.Err()
+}
+
+// A SerDev that replays a capture. The RX frames following a TX frame are
+// made available once the client has written that TX frame; mismatched TX
+// frames are reported but do not stop the replay. At the end of the capture,
+// reads block (so requests time out) until the device is closed.
+type ReplayDev struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	recs     []CaptureRecord
+	idx      int
+	rxbuf    []byte
+	closed   bool
+	mismatch int // TX frames differing from the capture
+}
+
+func NewReplay(fn string) (*ReplayDev, error) {
+	recs, err := Read_capture(fn)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReplayDev{recs: recs}
+	r.cond = sync.NewCond(&r.mu)
+	r.queue_rx()
+	return r, nil
+}
+
+// Queues RX frames up to the next TX frame; caller holds the lock
+func (r *ReplayDev) queue_rx() {
+	for r.idx < len(r.recs) && !r.recs[r.idx].tx {
+		r.rxbuf = append(r.rxbuf, r.recs[r.idx].data...)
+		r.idx++
+	}
+	r.cond.Broadcast()
+}
+
+func (r *ReplayDev) Write(buf []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, errors.New("replay closed")
+	}
+	if r.idx < len(r.recs) {
+		if string(r.recs[r.idx].data) != string(buf) {
+			fmt.Fprintf(os.Stderr, "Replay: TX mismatch at %.6f\n", r.recs[r.idx].stamp)
+			r.mismatch++
+		}
+		r.idx++
+	} else {
+		fmt.Fprintln(os.Stderr, "Replay: end of capture")
+	}
+	r.queue_rx()
+	return len(buf), nil
+}
+
+func (r *ReplayDev) Read(buf []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.rxbuf) == 0 {
+		if r.closed {
+			return 0, io.EOF
+		}
+		r.cond.Wait()
+	}
+	n := copy(buf, r.rxbuf)
+	r.rxbuf = r.rxbuf[n:]
+	return n, nil
+}
+
+func (r *ReplayDev) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+	return nil
+}
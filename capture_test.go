@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// An MSP session replaying a capture, which must be followed exactly
+func replay_session(t *testing.T, fn string) *MSPSerial {
+	s := MSPInit(DevDescription{klass: DevClass_REPLAY, name: fn})
+	s.msgs = io.Discard
+	t.Cleanup(func() {
+		r := s.sd.(*ReplayDev)
+		r.mu.Lock()
+		if r.mismatch != 0 {
+			t.Errorf("%d TX frames differ from the capture", r.mismatch)
+		}
+		r.mu.Unlock()
+		s.recoverable = true // the reader ends on close
+		s.sd.Close()
+	})
+	return s
+}
+
+// bc.plan, with speeds, a POSHOLD_TIME and JUMPs
+func sample_mission(t *testing.T) *MultiMission {
+	mtype, mm, err := Read_Mission_File("samples/bc.plan")
+	if mm == nil || err != nil {
+		t.Fatalf("samples/bc.plan: %s %v", mtype, err)
+	}
+	sanitise_mission(mm, mtype)
+	return mm
+}
+
+func TestReplayInit(t *testing.T) {
+	s := replay_session(t, "testdata/download.cap")
+	want := FCInfo{Variant: "INAV", Version: "7.1.0", Board: "MATEKF405", Git: "0abcdef0", Api: "2.5", Name: "sim",
+		WpMax: 120, WpCount: 9, WpValid: 1}
+	if s.info != want {
+		t.Errorf("FC %+v, want %+v", s.info, want)
+	}
+	if s.fcvers != 0x70100 || !s.v2 || s.nowp {
+		t.Errorf("fcvers %x, v2 %v, nowp %v", s.fcvers, s.v2, s.nowp)
+	}
+}
+
+func TestReplayDownload(t *testing.T) {
+	s := replay_session(t, "testdata/download.cap")
+	mm := s.download(false)
+	want := sample_mission(t)
+	if d := Diff_missions(want, mm, false); len(d.lines) != 0 {
+		t.Errorf("downloaded mission differs:\n%s", strings.Join(d.lines, "\n"))
+	}
+	r := s.sd.(*ReplayDev)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.idx != len(r.recs) {
+		t.Errorf("replay stopped at record %d of %d", r.idx, len(r.recs))
+	}
+}
+
+// The CLI text is captured, so a CLI upload replays
+func TestReplayCLIUpload(t *testing.T) {
+	defer func(v string) { *via = v }(*via)
+	*via = "cli"
+	s := replay_session(t, "testdata/cli-upload.cap")
+	mm := sample_mission(t)
+	if !s.upload(mm, false) {
+		t.Fatal("CLI upload failed")
+	}
+	if d := Diff_missions(mm, s.cliwp, false); len(d.lines) != 0 {
+		t.Errorf("CLI mission differs:\n%s", strings.Join(d.lines, "\n"))
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The inav CLI over the MSP link, for FCs (or links) where the MSP WP
+// commands are unavailable or unreliable. The CLI is entered with '#'; each
+// command is echoed, followed by its output and the "# " prompt. Leaving the
+// CLI (save or exit) reboots the FC, which ends the FC session.
+
+const (
+	cli_PROMPT  = "\n# "
+	cli_TIMEOUT = 3 * time.Second
+	cli_QUIET   = 100 * time.Millisecond // after a prompt, for more output
+)
+
+var cli_closed = errors.New("CLI link closed")
+
+func (m *MSPSerial) use_cli() bool {
+	return *via == "cli" || m.nowp
+}
+
+// Reads CLI text until it ends with end and nothing more arrives (the prompt
+// may also appear in output, e.g. "# version"), the link closes or nothing is
+// received for the timeout
+func (m *MSPSerial) cli_read(end string) (string, error) {
+	var sb strings.Builder
+	for {
+		tmo := cli_TIMEOUT
+		if strings.HasSuffix(sb.String(), end) {
+			tmo = cli_QUIET
+		}
+		select {
+		case b, ok := <-m.txt:
+			if !ok {
+				return sb.String(), cli_closed
+			}
+			sb.Write(b)
+		case <-time.After(tmo):
+			if tmo == cli_QUIET {
+				return sb.String(), nil
+			}
+			return sb.String(), errors.New("CLI timeout")
+		}
+	}
+}
+
+func (m *MSPSerial) cli_enter() error {
+	m.txt = make(chan []byte, 256)
+	m.cli.Store(true)
+	m.write([]byte("#"))
+	if _, err := m.cli_read(cli_PROMPT); err != nil {
+		m.cli.Store(false)
+		return fmt.Errorf("Failed to enter the CLI: %v", err)
+	}
+	return nil
+}
+
+// Runs a CLI command, returning its output. The echo is checked, as a
+// command corrupted on the link may still be valid.
+func (m *MSPSerial) cli_command(line string) (string, error) {
+	m.write([]byte(line + "\n"))
+	out, err := m.cli_read(cli_PROMPT)
+	out = strings.ReplaceAll(out, "\r", "")
+	if err != nil {
+		return out, err
+	}
+	out = strings.TrimSuffix(out, cli_PROMPT)
+	echo, rest, _ := strings.Cut(out, "\n")
+	if echo != line {
+		return rest, fmt.Errorf("echo \"%s\" for \"%s\"", echo, line)
+	}
+	return rest, nil
+}
+
+// Leaves the CLI with save or exit (discarding any changes); either reboots
+// the FC, which may close the link
+func (m *MSPSerial) cli_exit(save bool) error {
+	cmd := "exit"
+	if save {
+		cmd = "save"
+	}
+	m.write([]byte(cmd + "\n"))
+	if _, err := m.cli_read("Rebooting"); err != nil && err != cli_closed {
+		return err
+	}
+	return nil
+}
+
+// The CLI reports errors as e.g. "Parse error", "Invalid name"; comment
+// lines (e.g. "#wp 0 invalid") are output
+func cli_error(out string) bool {
+	for _, ln := range strings.Split(out, "\n") {
+		if lo := strings.ToLower(strings.TrimSpace(ln)); !strings.HasPrefix(lo, "#") {
+			if strings.Contains(lo, "error") || strings.Contains(lo, "invalid") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Uploads the mission by pasting the To_cli wp (and fwapproach) lines. The
+// FC mission is then listed, checked and kept for -verify, and saved.
+func (s *MSPSerial) cli_upload(mm *MultiMission) bool {
+	if !mm.valid_for(s.info.WpMax) {
+		for _, p := range mm.validate(s.info.WpMax) {
+			s.printf("  %s\n", p)
+		}
+		s.printf("Mission fails verification, upload cancelled\n")
+		return false
+	}
+	var sb strings.Builder
+	mm.To_cli(&sb)
+	lines := []string{}
+	for _, ln := range strings.Split(sb.String(), "\n") {
+		f := strings.Fields(ln)
+		if len(f) > 0 && (f[0] == "wp" || (f[0] == "fwapproach" && s.fcvers >= 0x70100)) {
+			lines = append(lines, strings.Join(f, " "))
+		}
+	}
+	if err := s.cli_enter(); err != nil {
+		s.printf("%v\n", err)
+		return false
+	}
+	discard := func(format string, a ...interface{}) bool {
+		s.printf(format, a...)
+		s.printf("Upload cancelled, CLI changes discarded\n")
+		s.cli_exit(false)
+		return false
+	}
+	for j, ln := range lines {
+		if *verbose == false {
+			s.printf("Upload %d\r", j+1)
+		}
+		out, err := s.cli_command(ln)
+		if err == nil && cli_error(out) {
+			err = fmt.Errorf("\"%s\": %s", ln, strings.TrimSpace(out))
+		}
+		if err != nil {
+			return discard("CLI %v\n", err)
+		}
+	}
+	list, err := s.cli_command("wp")
+	if err != nil {
+		return discard("CLI %v\n", err)
+	}
+	if s.fcvers >= 0x70100 {
+		fwa, err := s.cli_command("fwapproach")
+		if err != nil {
+			return discard("CLI %v\n", err)
+		}
+		list += fwa
+	}
+	count, valid := cli_wp_status(list)
+	nwp := mm.wp_count()
+	s.printf("Waypoints: %d of %d, valid %v\n", count, s.info.WpMax, valid)
+	if count != nwp || !valid {
+		return discard("CLI mission incomplete\n")
+	}
+	if err := s.cli_exit(true); err != nil {
+		s.printf("CLI save: %v\n", err)
+		return false
+	}
+	s.cliwp = read_inav_cli([]byte(list))
+	s.info.WpCount = count
+	s.info.WpValid = 1
+	s.printf("upload %d via CLI, saved\n", nwp)
+	return true
+}
+
+// The "#wp <count> valid|invalid" line of a CLI wp listing
+func cli_wp_status(list string) (int, bool) {
+	count, valid := -1, false
+	for _, ln := range strings.Split(list, "\n") {
+		if f := strings.Fields(ln); len(f) == 3 && f[0] == "#wp" {
+			count, _ = strconv.Atoi(f[1])
+			valid = f[2] == "valid"
+		}
+	}
+	return count, valid
+}
+
+// Lists the FC mission (loaded from EEPROM first for eeprom) over the CLI,
+// for FCs without the MSP WP commands. As leaving the CLI reboots the FC, the
+// mission is kept, as for a CLI upload.
+func (s *MSPSerial) cli_list(eeprom bool) error {
+	if err := s.cli_enter(); err != nil {
+		return err
+	}
+	cmds := []string{"wp"}
+	if eeprom {
+		cmds = append([]string{"wp load"}, cmds...)
+	}
+	if s.fcvers >= 0x70100 {
+		cmds = append(cmds, "fwapproach")
+	}
+	list := ""
+	for _, c := range cmds {
+		out, err := s.cli_command(c)
+		if err == nil && cli_error(out) {
+			err = fmt.Errorf("\"%s\": %s", c, strings.TrimSpace(out))
+		}
+		if err != nil {
+			s.cli_exit(false)
+			return fmt.Errorf("CLI %v", err)
+		}
+		list += out
+	}
+	if err := s.cli_exit(false); err != nil {
+		return fmt.Errorf("CLI exit: %v", err)
+	}
+	count, valid := cli_wp_status(list)
+	if count < 0 {
+		return errors.New("CLI wp listing not recognised")
+	}
+	s.cliwp = read_inav_cli([]byte(list))
+	s.info.WpCount = count
+	s.info.WpValid = 0
+	if valid {
+		s.info.WpValid = 1
+	}
+	s.printf("Waypoints (via CLI): %d of %d, valid %v\n", count, s.info.WpMax, valid)
+	return nil
+}
+
+// Runs the script's commands (comments and blank lines are skipped), writing
+// the commands and their output to w. The CLI is left at the script's save or
+// exit, or otherwise with save for -save, exit (discarding changes) if not.
+// A command that fails stops the script, discarding the changes.
+func (s *MSPSerial) cli_exec(script []byte, w io.Writer) bool {
+	if err := s.cli_enter(); err != nil {
+		s.printf("%v\n", err)
+		return false
+	}
+	ok := true
+	leave := *save
+	scanner := bufio.NewScanner(strings.NewReader(string(script)))
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if f[0] == "save" || f[0] == "exit" {
+			leave = f[0] == "save"
+			break
+		}
+		ln := strings.Join(f, " ")
+		fmt.Fprintf(w, "# %s\n", ln)
+		out, err := s.cli_command(ln)
+		if out = strings.TrimRight(out, "\n"); out != "" {
+			fmt.Fprintln(w, out)
+		}
+		if err == cli_closed {
+			s.printf("CLI %v\n", err)
+			return false
+		}
+		if err == nil && cli_error(out) {
+			err = fmt.Errorf("\"%s\" failed", ln)
+		}
+		if err != nil {
+			s.printf("CLI %v\n", err)
+			ok, leave = false, false
+			break
+		}
+	}
+	if err := s.cli_exit(leave); err != nil {
+		s.printf("CLI exit: %v\n", err)
+		return false
+	}
+	if leave {
+		s.printf("CLI saved\n")
+	} else {
+		s.printf("CLI left without saving\n")
+	}
+	return ok
+}
+
+func do_cli_exec(inf string, outf string) {
+	r := NewResult("cli-exec", false)
+	r.File = inf
+	fh, err := openStdinOrFile(inf)
+	if err != nil {
+		r.fail(EXIT_USAGE, "%v", err)
+		r.exit()
+	}
+	script, err := io.ReadAll(fh)
+	fh.Close()
+	if err != nil {
+		r.fail(EXIT_USAGE, "%v", err)
+		r.exit()
+	}
+	w, err := openStdoutOrFile(outf)
+	if err != nil {
+		r.fail(EXIT_USAGE, "%v", err)
+		r.exit()
+	}
+	r.run_fc(func(s *MSPSerial) bool {
+		return s.cli_exec(script, w)
+	})
+	if w != os.Stdout {
+		w.Close()
+	}
+	r.exit()
+}
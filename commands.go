@@ -0,0 +1,313 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Command struct {
+	names []string
+	args  string
+	help  string
+	min   int
+	max   int // -1 for no limit
+	// Registers the command's options, returning the command
+	setup func(fs *flag.FlagSet) func(args []string)
+}
+
+func json_option(fs *flag.FlagSet) *bool {
+	return fs.Bool("json", false, "Report the result as JSON (on stdout)")
+}
+
+func no_options(run func(args []string)) func(fs *flag.FlagSet) func(args []string) {
+	return func(fs *flag.FlagSet) func(args []string) { return run }
+}
+
+func upload_command(eeprom bool) func(fs *flag.FlagSet) func(args []string) {
+	return func(fs *flag.FlagSet) func(args []string) {
+		verify := fs.Bool("verify", false, "Download and compare the mission after uploading")
+		jsonout := json_option(fs)
+		return func(args []string) {
+			inf, _ := verify_in_out_files(args)
+			do_upload(inf, eeprom, *verify, *jsonout)
+		}
+	}
+}
+
+func download_command(eeprom bool) func(fs *flag.FlagSet) func(args []string) {
+	return func(fs *flag.FlagSet) func(args []string) {
+		jsonout := json_option(fs)
+		return func(args []string) {
+			outf, _ := verify_in_out_files(args)
+			do_download(outf, eeprom, *jsonout)
+		}
+	}
+}
+
+var commands = []Command{
+	{names: []string{"upload", "up"}, args: "[FILE]", max: 1,
+		help:  "Uploads a mission to the FC",
+		setup: upload_command(false)},
+	{names: []string{"store", "sto"}, args: "[FILE]", max: 1,
+		help:  "Uploads a mission to the FC and saves it to EEPROM",
+		setup: upload_command(true)},
+	{names: []string{"download", "down"}, args: "[FILE]", max: 1,
+		help:  "Downloads the mission from FC volatile memory",
+		setup: download_command(false)},
+	{names: []string{"restore", "rest"}, args: "[FILE]", max: 1,
+		help:  "Restores the mission from EEPROM and downloads it",
+		setup: download_command(true)},
+	{names: []string{"convert", "conv"}, args: "[FILE [OUTFILE]]", max: 2,
+		help: "Converts a mission file to the -fmt format",
+		setup: no_options(func(args []string) {
+			do_convert(verify_in_out_files(args))
+		})},
+	{names: []string{"test"}, help: "Reports the FC identity and WP counts",
+		setup: func(fs *flag.FlagSet) func(args []string) {
+			jsonout := json_option(fs)
+			return func(args []string) { do_test(*jsonout) }
+		}},
+	{names: []string{"clear"}, help: "Removes the mission from FC volatile memory",
+		setup: no_options(func(args []string) { do_clear(false) })},
+	{names: []string{"erase"}, help: "Removes the mission from FC volatile memory and EEPROM",
+		setup: no_options(func(args []string) { do_clear(true) })},
+	{names: []string{"home"}, help: "Reports the FC GPS fix and home location",
+		setup: no_options(func(args []string) { do_home() })},
+	{names: []string{"multi"}, args: "[N]", max: 1,
+		help: "Gets, or sets and saves (multi=N or multi N), the multi-mission index",
+		setup: func(fs *flag.FlagSet) func(args []string) {
+			jsonout := json_option(fs)
+			return func(args []string) {
+				idx := -1
+				if len(args) == 1 {
+					n, err := strconv.Atoi(args[0])
+					if err != nil || n < 0 || n > MAX_SEGMENTS {
+						fmt.Fprintf(os.Stderr, "multi: invalid index \"%s\" (0-%d)\n", args[0], MAX_SEGMENTS)
+						os.Exit(EXIT_USAGE)
+					}
+					idx = n
+				}
+				do_multi(idx, *jsonout)
+			}
+		}},
+	{names: []string{"get"}, args: "NAME ...", min: 1, max: -1,
+		help:  "Gets FC settings",
+		setup: no_options(do_get_settings)},
+	{names: []string{"set"}, args: "NAME=VALUE|FILE ...", min: 1, max: -1,
+		help:  "Sets FC settings (and saves them with -save)",
+		setup: no_options(do_set_settings)},
+	{names: []string{"seg"}, args: "list | put N FILE | del N | move FROM TO", max: 3,
+		help:  "Lists or edits the segments of the FC's multi-mission",
+		setup: no_options(do_segments)},
+	{names: []string{"merge"}, args: "FILE FILE ...", min: 2, max: -1,
+		help: "Merges missions into a multi-mission",
+		setup: func(fs *flag.FlagSet) func(args []string) {
+			outf := fs.String("o", "-", "Output file")
+			return func(args []string) { do_merge(args, *outf) }
+		}},
+	{names: []string{"split"}, args: "FILE DIR", min: 2, max: 2,
+		help:  "Splits a multi-mission into one file per segment",
+		setup: no_options(do_split)},
+	{names: []string{"extract"}, args: "FILE [OUTFILE]", min: 1, max: 2,
+		help: "Extracts a segment of a multi-mission",
+		setup: func(fs *flag.FlagSet) func(args []string) {
+			seg := fs.Int("seg", 0, "Segment (1-9, required)")
+			return func(args []string) { do_extract(*seg, args) }
+		}},
+	{names: []string{"diff"}, args: "A B", min: 2, max: 2,
+		help:  "Compares missions (files, fc: or fc-eeprom:)",
+		setup: no_options(do_diff)},
+	{names: []string{"proxy"},
+		help: "Shares the FC link with TCP MSP clients",
+		setup: func(fs *flag.FlagSet) func(args []string) {
+			laddr := fs.String("listen", "", "Listen address, tcp://[host]:port (required)")
+			return func(args []string) { do_proxy(*laddr) }
+		}},
+	{names: []string{"serve"},
+		help: "Runs the HTTP / JSON API",
+		setup: func(fs *flag.FlagSet) func(args []string) {
+			laddr := fs.String("listen", "localhost:8080", "Listen address, [host]:port")
+			origins := fs.String("origin", "", "Allowed origins for FC requests (comma separated URLs, or *)")
+			return func(args []string) { do_serve(*laddr, *origins) }
+		}},
+	{names: []string{"wsbridge"},
+		help: "Bridges the FC link to WebSocket clients",
+		setup: func(fs *flag.FlagSet) func(args []string) {
+			laddr := fs.String("listen", "localhost:8081", "Listen address, [host]:port")
+			origins := fs.String("origin", "", "Allowed origins (comma separated URLs, or *)")
+			return func(args []string) { do_wsbridge(*laddr, *origins) }
+		}},
+	{names: []string{"watch"}, args: "FILE", min: 1, max: 1,
+		help: "Converts or uploads a mission file each time it is saved",
+		setup: func(fs *flag.FlagSet) func(args []string) {
+			outf := fs.String("o", "", "Convert to this file, rather than upload")
+			store := fs.Bool("store", false, "Save uploaded missions to EEPROM")
+			return func(args []string) { do_watch(args[0], *outf, *store) }
+		}},
+	{names: []string{"fleet"}, args: "upload|store [FILE]", min: 1, max: 2,
+		help: "Uploads missions to several FCs concurrently",
+		setup: func(fs *flag.FlagSet) func(args []string) {
+			devfile := fs.String("devices", "", "Device list file, one \"DEVICE [FILE]\" per line (required)")
+			verify := fs.Bool("verify", false, "Download and compare each mission after uploading")
+			jsonout := json_option(fs)
+			return func(args []string) { do_fleet(*devfile, args, *verify, *jsonout) }
+		}},
+	{names: []string{"cli-exec"}, args: "FILE [OUTFILE]", min: 1, max: 2,
+		help: "Runs an inav CLI script on the FC, capturing its output",
+		setup: no_options(func(args []string) {
+			outf := ""
+			if len(args) > 1 {
+				outf = args[1]
+			}
+			do_cli_exec(args[0], outf)
+		})},
+	{names: []string{"shell"}, help: "Runs an interactive session on one FC connection",
+		setup: no_options(func(args []string) { do_shell() })},
+	{names: []string{"version"}, help: "Shows the version",
+		setup: no_options(func(args []string) { fmt.Fprintln(os.Stderr, GetVersion()) })},
+}
+
+// help refers to the command table, so is added at initialisation
+func init() {
+	commands = append(commands, Command{names: []string{"help"}, args: "[COMMAND]", max: 1,
+		help: "Shows help for a command", setup: no_options(do_help)})
+}
+
+func find_command(name string) *Command {
+	for j := range commands {
+		for _, n := range commands[j].names {
+			if n == name {
+				return &commands[j]
+			}
+		}
+	}
+	return nil
+}
+
+func main_usage() {
+	fmt.Fprintf(os.Stderr, "Usage of impload [options] command [command options] [files ...]\n")
+	fmt.Fprintf(os.Stderr, "Options:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", strings.Join(c.names, ","), c.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nUse \"impload help COMMAND\" for the command's options.\n")
+	fmt.Fprintln(os.Stderr, GetVersion())
+}
+
+// Shows the command's own options (the global options are also accepted)
+func (c *Command) usage(fs *flag.FlagSet, own map[string]bool) {
+	opts := ""
+	if len(own) > 0 {
+		opts = " [options]"
+	}
+	fmt.Fprintf(os.Stderr, "Usage: impload %s%s %s\n  %s\n", c.names[0], opts, c.args, c.help)
+	if len(c.names) > 1 {
+		fmt.Fprintf(os.Stderr, "  Aliases: %s\n", strings.Join(c.names[1:], ", "))
+	}
+	if len(own) > 0 {
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.VisitAll(func(f *flag.Flag) {
+			if !own[f.Name] {
+				return
+			}
+			name, usage := flag.UnquoteUsage(f)
+			s := "  -" + f.Name
+			if name != "" {
+				s += " " + name
+			}
+			fmt.Fprintf(os.Stderr, "%s\n    \t%s", s, usage)
+			if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" {
+				fmt.Fprintf(os.Stderr, " (default %q)", f.DefValue)
+			}
+			fmt.Fprintln(os.Stderr)
+		})
+	}
+	fmt.Fprintf(os.Stderr, "Global options (see impload -h) may also follow the command.\n")
+}
+
+// Parses options given before or after the arguments; "--" ends the options
+func parse_interleaved(fs *flag.FlagSet, args []string) ([]string, error) {
+	rest := []string{}
+	for len(args) > 0 {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		remain := fs.Args()
+		if n := len(args) - len(remain); n > 0 && args[n-1] == "--" {
+			return append(rest, remain...), nil
+		}
+		if len(remain) == 0 {
+			break
+		}
+		rest = append(rest, remain[0])
+		args = remain[1:]
+	}
+	return rest, nil
+}
+
+// Returns the command's flag set, with its own options and the global options
+func (c *Command) flagset() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet(c.names[0], flag.ContinueOnError)
+	run := c.setup(fs)
+	own := map[string]bool{}
+	fs.VisitAll(func(f *flag.Flag) { own[f.Name] = true })
+	flag.VisitAll(func(f *flag.Flag) {
+		if !own[f.Name] {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fs.Usage = func() { c.usage(fs, own) }
+	return fs, run
+}
+
+func do_help(args []string) {
+	if len(args) == 0 {
+		main_usage()
+		return
+	}
+	c := find_command(args[0])
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "impload: unrecognised command \"%s\"\n", args[0])
+		os.Exit(EXIT_USAGE)
+	}
+	fs, _ := c.flagset()
+	fs.Usage()
+}
+
+func run_command(name string, args []string) {
+	// Legacy form of "multi N"
+	if strings.HasPrefix(name, "multi=") {
+		args = append([]string{name[6:]}, args...)
+		name = "multi"
+	}
+	c := find_command(name)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "impload: unrecognised command \"%s\"\n", name)
+		os.Exit(EXIT_USAGE)
+	}
+	fs, run := c.flagset()
+	args, err := parse_interleaved(fs, args)
+	if err == flag.ErrHelp {
+		os.Exit(EXIT_OK)
+	} else if err != nil {
+		os.Exit(EXIT_USAGE)
+	}
+	if len(args) < c.min || (c.max >= 0 && len(args) > c.max) {
+		fs.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+	if *via != "msp" && *via != "cli" {
+		fmt.Fprintf(os.Stderr, "impload: invalid -via \"%s\" (msp, cli)\n", *via)
+		os.Exit(EXIT_USAGE)
+	}
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	apply_config(given)
+	run(args)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+import (
+	"geo"
+)
+
+// Configuration file, a (small) subset of TOML:
+//
+//	# global settings
+//	default_profile = "wing"  # as -profile
+//	serial_host = "10.0.0.1"  # as MWP_SERIAL_HOST
+//	no_verify = false         # as IMPLOAD_NO_VERIFY
+//
+//	[profile.wing]
+//	device = "/dev/ttyACM0"
+//	baud = 115200
+//	alt = 50
+//	speed = 12.5
+//	min_alt = 30
+//	max_alt = 120
+//	max_range = 2000
+//	type = "fixedwing"        # or "multirotor"
+//	turn_radius = 35
+//
+// Values are strings (double or single quoted), numbers or booleans.
+
+type Profile struct {
+	Name       string
+	Device     string
+	Baud       int
+	Alt        int
+	Speed      float64
+	MinAlt     int
+	MaxAlt     int
+	MaxRange   float64
+	FixedWing  bool
+	TurnRadius float64
+	Format     string
+	ForceRTH   bool
+	ForceLand  bool
+}
+
+type Config struct {
+	Default    string
+	SerialHost string
+	NoVerify   bool
+	Profiles   map[string]*Profile
+}
+
+var (
+	config  = &Config{Profiles: map[string]*Profile{}}
+	profile *Profile
+)
+
+func default_config_file() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "impload", "config.toml")
+}
+
+func parse_config_value(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, "\""):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s == "true" || s == "false":
+		return s == "true", nil
+	}
+	if f, err := strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid value %s", s)
+}
+
+// Removes a comment, allowing for '#' in strings
+func strip_comment(s string) string {
+	var quote rune
+	for j, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return s[:j]
+		}
+	}
+	return s
+}
+
+func (p *Profile) set(key string, val interface{}) error {
+	sval, isstr := val.(string)
+	fval, isnum := val.(float64)
+	bval, isbool := val.(bool)
+	ok := true
+	switch key {
+	case "device":
+		p.Device, ok = sval, isstr
+	case "fmt", "format":
+		p.Format, ok = sval, isstr
+	case "type":
+		switch sval {
+		case "fixedwing", "fixed-wing", "fw", "plane":
+			p.FixedWing = true
+		case "multirotor", "mr", "copter":
+			p.FixedWing = false
+		default:
+			return fmt.Errorf("invalid type \"%s\" (fixedwing or multirotor)", sval)
+		}
+	case "baud":
+		p.Baud, ok = int(fval), isnum
+	case "alt":
+		p.Alt, ok = int(fval), isnum
+	case "speed":
+		p.Speed, ok = fval, isnum
+	case "min_alt":
+		p.MinAlt, ok = int(fval), isnum
+	case "max_alt":
+		p.MaxAlt, ok = int(fval), isnum
+	case "max_range":
+		p.MaxRange, ok = fval, isnum
+	case "turn_radius":
+		p.TurnRadius, ok = fval, isnum
+	case "force_rth":
+		p.ForceRTH, ok = bval, isbool
+	case "force_land":
+		p.ForceLand, ok = bval, isbool
+	default:
+		return fmt.Errorf("unknown profile key %s", key)
+	}
+	if !ok {
+		return fmt.Errorf("invalid value for %s", key)
+	}
+	return nil
+}
+
+func (c *Config) set(key string, val interface{}) error {
+	ok := true
+	switch key {
+	case "default_profile":
+		c.Default, ok = val.(string)
+	case "serial_host":
+		c.SerialHost, ok = val.(string)
+	case "no_verify":
+		c.NoVerify, ok = val.(bool)
+	default:
+		return fmt.Errorf("unknown key %s", key)
+	}
+	if !ok {
+		return fmt.Errorf("invalid value for %s", key)
+	}
+	return nil
+}
+
+func Read_config(fn string) (*Config, error) {
+	r, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	c := &Config{Profiles: map[string]*Profile{}}
+	var p *Profile
+	scanner := bufio.NewScanner(r)
+	lno := 0
+	for scanner.Scan() {
+		lno++
+		ln := strings.TrimSpace(strip_comment(scanner.Text()))
+		if len(ln) == 0 {
+			continue
+		}
+		if strings.HasPrefix(ln, "[") && strings.HasSuffix(ln, "]") {
+			sect := strings.TrimSpace(ln[1 : len(ln)-1])
+			name := strings.Trim(strings.TrimPrefix(sect, "profile."), "\"")
+			if !strings.HasPrefix(sect, "profile.") || name == "" {
+				return nil, fmt.Errorf("%s:%d: invalid section [%s]", fn, lno, sect)
+			}
+			p = &Profile{Name: name}
+			c.Profiles[name] = p
+			continue
+		}
+		parts := strings.SplitN(ln, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: invalid line", fn, lno)
+		}
+		key := strings.TrimSpace(parts[0])
+		val, err := parse_config_value(strings.TrimSpace(parts[1]))
+		if err == nil {
+			if p != nil {
+				err = p.set(key, val)
+			} else {
+				err = c.set(key, val)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fn, lno, err)
+		}
+	}
+	return c, scanner.Err()
+}
+
+// Reads the configuration file and applies the selected profile to any
+// options not given on the command line
+func apply_config(given map[string]bool) {
+	fn := *cfgfile
+	if fn == "" {
+		fn = default_config_file()
+	}
+	if fn != "" {
+		c, err := Read_config(fn)
+		if err == nil {
+			config = c
+		} else if *cfgfile != "" || !os.IsNotExist(err) {
+			log.Println(err)
+			os.Exit(EXIT_USAGE)
+		}
+	}
+
+	name := *pname
+	if name == "" {
+		name = config.Default
+	}
+	if name == "" {
+		return
+	}
+	p, ok := config.Profiles[name]
+	if !ok {
+		log.Printf("Unknown profile \"%s\"\n", name)
+		os.Exit(EXIT_USAGE)
+	}
+	profile = p
+
+	if !given["d"] && p.Device != "" {
+		*device = p.Device
+	}
+	if !given["b"] && p.Baud != 0 {
+		*baud = p.Baud
+	}
+	if !given["a"] && p.Alt != 0 {
+		*defalt = p.Alt
+	}
+	if !given["s"] && p.Speed != 0 {
+		*defspeed = p.Speed
+	}
+	if !given["fmt"] && p.Format != "" {
+		*outfmt = p.Format
+	}
+	if !given["force-rth"] && p.ForceRTH {
+		*force_rtl = true
+	}
+	if !given["force-land"] && p.ForceLand {
+		*force_land = true
+	}
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "Using profile %s\n", p.Name)
+	}
+}
+
+// The environment overrides the configuration file
+func serial_host() string {
+	if s := os.Getenv("MWP_SERIAL_HOST"); s != "" {
+		return s
+	}
+	return config.SerialHost
+}
+
+func no_verify() bool {
+	return os.Getenv("IMPLOAD_NO_VERIFY") != "" || config.NoVerify
+}
+
+// Checks the mission against the profile's limits. Only altitudes relative
+// to home are checked; the range is from the planned home if set, otherwise
+// the segment's first geographic WP
+func (mm *MultiMission) profile_problems() []string {
+	problems := []string{}
+	p := profile
+	if p == nil {
+		return problems
+	}
+	for j, ms := range mm.Segment {
+		hlat, hlon := ms.Metadata.Homey, ms.Metadata.Homex
+		var prev *MissionItem
+		for k := range ms.MissionItems {
+			mi := &ms.MissionItems[k]
+			if !mi.is_GeoPoint() {
+				continue
+			}
+			if hlat == 0 && hlon == 0 {
+				hlat, hlon = mi.Lat, mi.Lon
+			}
+			if mi.P3&1 == 0 {
+				if p.MaxAlt > 0 && int(mi.Alt) > p.MaxAlt {
+					problems = append(problems, fmt.Sprintf("segment %d, WP %d: altitude %dm above %s maximum (%dm)", j+1, k+1, mi.Alt, p.Name, p.MaxAlt))
+				}
+				if p.MinAlt > 0 && mi.Action != "LAND" && mi.Alt != 0 && int(mi.Alt) < p.MinAlt {
+					problems = append(problems, fmt.Sprintf("segment %d, WP %d: altitude %dm below %s minimum (%dm)", j+1, k+1, mi.Alt, p.Name, p.MinAlt))
+				}
+			}
+			if p.MaxRange > 0 {
+				_, d := geo.Csedist(hlat, hlon, mi.Lat, mi.Lon)
+				if d*1852.0 > p.MaxRange {
+					problems = append(problems, fmt.Sprintf("segment %d, WP %d: range %.0fm exceeds %s maximum (%.0fm)", j+1, k+1, d*1852.0, p.Name, p.MaxRange))
+				}
+			}
+			if p.FixedWing && p.TurnRadius > 0 && prev != nil {
+				_, d := geo.Csedist(prev.Lat, prev.Lon, mi.Lat, mi.Lon)
+				if d*1852.0 < p.TurnRadius {
+					problems = append(problems, fmt.Sprintf("segment %d, WP %d: leg %.0fm shorter than %s turn radius (%.0fm)", j+1, k+1, d*1852.0, p.Name, p.TurnRadius))
+				}
+			}
+			prev = mi
+		}
+	}
+	return problems
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+import (
+	"geo"
+)
+
+type MissionDiff struct {
+	lines []string
+}
+
+func (d *MissionDiff) add(format string, a ...interface{}) {
+	d.lines = append(d.lines, fmt.Sprintf(format, a...))
+}
+
+func wp_summary(mi MissionItem) string {
+	if mi.is_GeoPoint() {
+		return fmt.Sprintf("%s %.7f %.7f %dm p1=%d p2=%d p3=%d", mi.Action, mi.Lat, mi.Lon, mi.Alt, mi.P1, mi.P2, mi.P3)
+	}
+	return fmt.Sprintf("%s p1=%d p2=%d p3=%d", mi.Action, mi.P1, mi.P2, mi.P3)
+}
+
+// Positions are compared at the FC's resolution (1e-7 degree); the FC
+// truncates, so a position read back may differ by up to one unit
+func same_position(a, b MissionItem) bool {
+	near := func(x, y float64) bool {
+		d := int64(int32(x*1e7)) - int64(int32(y*1e7))
+		return d >= -1 && d <= 1
+	}
+	return near(a.Lat, b.Lat) && near(a.Lon, b.Lon)
+}
+
+func diff_wp(a, b MissionItem) []string {
+	changes := []string{}
+	if a.Action != b.Action {
+		changes = append(changes, fmt.Sprintf("action %s -> %s", a.Action, b.Action))
+	}
+	if (a.is_GeoPoint() || b.is_GeoPoint()) && !same_position(a, b) {
+		cse, dist := geo.Csedist(a.Lat, a.Lon, b.Lat, b.Lon)
+		changes = append(changes, fmt.Sprintf("moved %.1fm (%03.0f°)", dist*1852.0, cse))
+	}
+	if a.Alt != b.Alt {
+		changes = append(changes, fmt.Sprintf("alt %d -> %d", a.Alt, b.Alt))
+	}
+	if a.P1 != b.P1 {
+		changes = append(changes, fmt.Sprintf("p1 %d -> %d", a.P1, b.P1))
+	}
+	if a.P2 != b.P2 {
+		changes = append(changes, fmt.Sprintf("p2 %d -> %d", a.P2, b.P2))
+	}
+	if a.P3 != b.P3 {
+		changes = append(changes, fmt.Sprintf("p3 %d -> %d", a.P3, b.P3))
+	}
+	if a.Flag != b.Flag {
+		changes = append(changes, fmt.Sprintf("flag %d -> %d", a.Flag, b.Flag))
+	}
+	return changes
+}
+
+func has_fwapproach(f FWApproach) bool {
+	return f.No > 7 && (f.Dirn1 != 0 || f.Dirn2 != 0)
+}
+
+func diff_fwa(a, b FWApproach) []string {
+	changes := []string{}
+	ha := has_fwapproach(a)
+	hb := has_fwapproach(b)
+	switch {
+	case !ha && !hb:
+	case !ha:
+		changes = append(changes, "FW approach added")
+	case !hb:
+		changes = append(changes, "FW approach removed")
+	default:
+		if a.Appalt != b.Appalt {
+			changes = append(changes, fmt.Sprintf("FW approach alt %d -> %d", a.Appalt, b.Appalt))
+		}
+		if a.Landalt != b.Landalt {
+			changes = append(changes, fmt.Sprintf("FW land alt %d -> %d", a.Landalt, b.Landalt))
+		}
+		if a.Dirn1 != b.Dirn1 || a.Dirn2 != b.Dirn2 {
+			changes = append(changes, fmt.Sprintf("FW headings %d/%d -> %d/%d", a.Dirn1, a.Dirn2, b.Dirn1, b.Dirn2))
+		}
+		if a.Dref != b.Dref {
+			changes = append(changes, fmt.Sprintf("FW direction %s -> %s", a.Dref, b.Dref))
+		}
+		if a.Aref != b.Aref {
+			changes = append(changes, fmt.Sprintf("FW sea level ref %v -> %v", a.Aref, b.Aref))
+		}
+	}
+	return changes
+}
+
+func Diff_missions(a, b *MultiMission, with_settings bool) *MissionDiff {
+	d := &MissionDiff{}
+	if len(a.Segment) != len(b.Segment) {
+		d.add("Segments: %d -> %d", len(a.Segment), len(b.Segment))
+	}
+	nseg := len(a.Segment)
+	if len(b.Segment) > nseg {
+		nseg = len(b.Segment)
+	}
+	for j := 0; j < nseg; j++ {
+		if j >= len(a.Segment) {
+			d.add("Segment %d: added (%d WP)", j+1, len(b.Segment[j].MissionItems))
+			continue
+		}
+		if j >= len(b.Segment) {
+			d.add("Segment %d: removed (%d WP)", j+1, len(a.Segment[j].MissionItems))
+			continue
+		}
+		sa := a.Segment[j].MissionItems
+		sb := b.Segment[j].MissionItems
+		nmi := len(sa)
+		if len(sb) > nmi {
+			nmi = len(sb)
+		}
+		for k := 0; k < nmi; k++ {
+			switch {
+			case k >= len(sa):
+				d.add("Segment %d: WP %d added: %s", j+1, k+1, wp_summary(sb[k]))
+			case k >= len(sb):
+				d.add("Segment %d: WP %d removed: %s", j+1, k+1, wp_summary(sa[k]))
+			default:
+				if c := diff_wp(sa[k], sb[k]); len(c) > 0 {
+					d.add("Segment %d: WP %d changed: %s", j+1, k+1, strings.Join(c, ", "))
+				}
+			}
+		}
+		for _, c := range diff_fwa(a.Segment[j].FWApproach, b.Segment[j].FWApproach) {
+			d.add("Segment %d: %s", j+1, c)
+		}
+	}
+	if with_settings {
+		for _, sa := range a.Settings {
+			found := false
+			for _, sb := range b.Settings {
+				if sa.Name == sb.Name {
+					found = true
+					if sa.Value != sb.Value {
+						d.add("Setting %s: %s -> %s", sa.Name, sa.Value, sb.Value)
+					}
+					break
+				}
+			}
+			if !found {
+				d.add("Setting %s: removed", sa.Name)
+			}
+		}
+		for _, sb := range b.Settings {
+			found := false
+			for _, sa := range a.Settings {
+				if sa.Name == sb.Name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				d.add("Setting %s: added (%s)", sb.Name, sb.Value)
+			}
+		}
+	}
+	return d
+}
+
+func is_fc_source(name string) bool {
+	return name == "fc:" || name == "fc-eeprom:"
+}
+
+// Loads a file, or the mission from the FC ("fc:" volatile, "fc-eeprom:")
+func load_diff_source(name string, s **MSPSerial) *MultiMission {
+	if is_fc_source(name) {
+		if *s == nil {
+			*s = MSPInitVolatile(check_device())
+		}
+		return (*s).download(name == "fc-eeprom:")
+	}
+	mtype, m, err := Read_Mission_File(name)
+	if m == nil || err != nil {
+		fmt.Fprintf(os.Stderr, "diff: invalid input file %s\n", name)
+		os.Exit(EXIT_USAGE)
+	}
+	sanitise_mission(m, mtype)
+	return m
+}
+
+// diff A B; exits 0 if the same, 1 if different, 2 for invalid arguments
+// or files, 3 on FC errors
+func do_diff(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: diff A B (files, fc: or fc-eeprom:)")
+		os.Exit(EXIT_USAGE)
+	}
+	var s *MSPSerial
+	mms := make([]*MultiMission, 2)
+	// fc-eeprom: loads the EEPROM into volatile memory, so read fc: first
+	order := []int{0, 1}
+	if args[0] == "fc-eeprom:" {
+		order = []int{1, 0}
+	}
+	for _, j := range order {
+		mms[j] = load_diff_source(args[j], &s)
+	}
+	with_settings := !is_fc_source(args[0]) && !is_fc_source(args[1])
+	d := Diff_missions(mms[0], mms[1], with_settings)
+	if len(d.lines) == 0 {
+		fmt.Fprintf(os.Stderr, "%s and %s are the same\n", args[0], args[1])
+		os.Exit(EXIT_OK)
+	}
+	fmt.Printf("--- %s\n+++ %s\n", args[0], args[1])
+	for _, l := range d.lines {
+		fmt.Println(l)
+	}
+	os.Exit(EXIT_FAIL)
+}
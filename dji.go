@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	"geo"
+)
+
+// Builds a mission from DJI style WPs (Litchi, WPML), where the heading and
+// POI are properties of each WP; SET_HEAD / SET_POI are only added on change
+type dji_builder struct {
+	src     string
+	mis     []MissionItem
+	heading int // -1 follow the path
+	poi     [2]float64
+	amsl    bool
+	notes   map[string]int
+}
+
+func new_dji_builder(src string) *dji_builder {
+	return &dji_builder{src: src, heading: -1, notes: map[string]int{}}
+}
+
+func (b *dji_builder) note(what string) {
+	b.notes[what]++
+}
+
+func (b *dji_builder) add(mi MissionItem) {
+	mi.No = len(b.mis) + 1
+	b.mis = append(b.mis, mi)
+}
+
+func (b *dji_builder) set_head(h float64) {
+	hdg := (int(math.Round(h)) + 360) % 360
+	b.head(hdg)
+}
+
+func (b *dji_builder) head(hdg int) {
+	if hdg != b.heading {
+		b.add(MissionItem{Action: "SET_HEAD", P1: int16(hdg)})
+		b.heading = hdg
+		b.poi = [2]float64{}
+	}
+}
+
+// Heading on the leg to lat,lon; within 5° of the course (or with no
+// previous WP) is following the path
+func (b *dji_builder) leg_head(h float64, lat, lon float64) {
+	hdg := -1
+	for k := len(b.mis) - 1; k >= 0; k-- {
+		if b.mis[k].is_GeoPoint() {
+			hdg = (int(math.Round(h)) + 360) % 360
+			cse, _ := geo.Csedist(b.mis[k].Lat, b.mis[k].Lon, lat, lon)
+			diff := math.Abs(cse - float64(hdg))
+			if diff > 180 {
+				diff = 360 - diff
+			}
+			if diff <= 5 {
+				hdg = -1
+			}
+			break
+		}
+	}
+	b.head(hdg)
+}
+
+func (b *dji_builder) follow_path() {
+	b.head(-1)
+}
+
+func (b *dji_builder) set_poi(lat, lon float64) {
+	if b.poi != [2]float64{lat, lon} {
+		b.add(MissionItem{Action: "SET_POI", Lat: lat, Lon: lon})
+		b.poi = [2]float64{lat, lon}
+		b.heading = -2 // unknown, any SET_HEAD is needed
+	}
+}
+
+// A WAYPOINT, or POSHOLD_TIME if hovering; speed in m/s (0 for the default)
+func (b *dji_builder) wp(lat, lon, alt, speed, hover float64, uact int16) {
+	mi := MissionItem{Action: "WAYPOINT", Lat: lat, Lon: lon, Alt: int32(math.Round(alt))}
+	spd := int16(math.Round(speed * 100))
+	if hover > 0 {
+		mi.Action = "POSHOLD_TIME"
+		mi.P1 = int16(math.Round(hover))
+		mi.P2 = spd
+	} else {
+		mi.P1 = spd
+	}
+	mi.P3 = uact
+	if b.amsl {
+		mi.P3 |= 1
+	}
+	b.add(mi)
+}
+
+func (b *dji_builder) mission() *MultiMission {
+	keys := []string{}
+	for k := range b.notes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(os.Stderr, "%s: %s (%d)\n", b.src, k, b.notes[k])
+	}
+	if len(b.mis) == 0 {
+		return nil
+	}
+	return NewMultiMission(b.mis)
+}
+
+func is_litchi(dat []byte) bool {
+	dat = bytes.TrimPrefix(dat, []byte("\xef\xbb\xbf"))
+	return bytes.HasPrefix(dat, []byte("latitude,longitude,altitude(m)"))
+}
+
+// Litchi CSV export; columns are found by name. Photos are user action 1,
+// "stay for" a hold time and "rotate aircraft" a SET_HEAD after the WP.
+func read_litchi(dat []byte) *MultiMission {
+	dat = bytes.TrimPrefix(dat, []byte("\xef\xbb\xbf"))
+	r := csv.NewReader(bytes.NewReader(dat))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil || len(records) < 2 {
+		fmt.Fprintf(os.Stderr, "Litchi error: %v\n", err)
+		return nil
+	}
+	cols := map[string]int{}
+	for j, h := range records[0] {
+		cols[strings.TrimSpace(h)] = j
+	}
+	field := func(rec []string, name string) float64 {
+		if j, ok := cols[name]; ok && j < len(rec) {
+			v, _ := strconv.ParseFloat(strings.TrimSpace(rec[j]), 64)
+			return v
+		}
+		return 0
+	}
+	b := new_dji_builder("Litchi")
+	for _, rec := range records[1:] {
+		if len(rec) < 3 {
+			continue
+		}
+		lat := field(rec, "latitude")
+		lon := field(rec, "longitude")
+		alt := field(rec, "altitude(m)")
+		if field(rec, "altitudemode") == 1 {
+			b.note("above ground altitudes flown as relative")
+		}
+		if field(rec, "curvesize(m)") > 0 {
+			b.note("curve size dropped")
+		}
+		if field(rec, "gimbalmode") != 0 {
+			b.note("gimbal pitch dropped")
+		}
+		if plat, plon := field(rec, "poi_latitude"), field(rec, "poi_longitude"); plat != 0 || plon != 0 {
+			b.set_poi(plat, plon)
+		} else if _, ok := cols["heading(deg)"]; ok {
+			b.leg_head(field(rec, "heading(deg)"), lat, lon)
+		}
+		hover := 0.0
+		uact := int16(0)
+		rotate := math.NaN()
+		for k := 1; k <= 15; k++ {
+			atype := field(rec, fmt.Sprintf("actiontype%d", k))
+			aparam := field(rec, fmt.Sprintf("actionparam%d", k))
+			if _, ok := cols[fmt.Sprintf("actiontype%d", k)]; !ok {
+				break
+			}
+			switch atype {
+			case -1:
+			case 0: // stay for (ms)
+				hover += aparam / 1000
+			case 1:
+				uact |= wp_USER1
+				b.note("take photo approximated as user action 1")
+			case 4:
+				rotate = aparam
+			case 2, 3:
+				b.note("start / stop recording dropped")
+			case 5:
+				b.note("tilt camera dropped")
+			default:
+				b.note(fmt.Sprintf("action %.0f dropped", atype))
+			}
+		}
+		b.wp(lat, lon, alt, field(rec, "speed(m/s)"), hover, uact)
+		if !math.IsNaN(rotate) {
+			b.set_head(rotate)
+		}
+	}
+	return b.mission()
+}
+
+type wpml_action struct {
+	Func  string `xml:"actionActuatorFunc"`
+	Param struct {
+		HoverTime float64 `xml:"hoverTime"`
+		Heading   float64 `xml:"aircraftHeading"`
+	} `xml:"actionActuatorFuncParam"`
+}
+
+type wpml_heading struct {
+	Mode  string  `xml:"waypointHeadingMode"`
+	Angle float64 `xml:"waypointHeadingAngle"`
+	Poi   string  `xml:"waypointPoiPoint"`
+}
+
+type wpml_placemark struct {
+	Coordinates     string        `xml:"Point>coordinates"`
+	Index           int           `xml:"index"`
+	ExecuteHeight   *float64      `xml:"executeHeight"`
+	Height          float64       `xml:"height"`
+	UseGlobalHeight int           `xml:"useGlobalHeight"`
+	Speed           float64       `xml:"waypointSpeed"`
+	UseGlobalSpeed  int           `xml:"useGlobalSpeed"`
+	Heading         wpml_heading  `xml:"waypointHeadingParam"`
+	UseGlobalHead   int           `xml:"useGlobalHeadingParam"`
+	GimbalPitch     float64       `xml:"gimbalPitchAngle"`
+	GimbalHeadPitch float64       `xml:"waypointGimbalHeadingParam>waypointGimbalPitchAngle"`
+	Actions         []wpml_action `xml:"actionGroup>action"`
+}
+
+type wpml_folder struct {
+	Speed         float64          `xml:"autoFlightSpeed"`
+	GlobalHeight  float64          `xml:"globalHeight"`
+	ExecuteMode   string           `xml:"executeHeightMode"`
+	HeightMode    string           `xml:"waylineCoordinateSysParam>heightMode"`
+	GlobalHeading wpml_heading     `xml:"globalWaypointHeadingParam"`
+	Placemarks    []wpml_placemark `xml:"Placemark"`
+}
+
+type wpml_doc struct {
+	FinishAction string        `xml:"Document>missionConfig>finishAction"`
+	Folders      []wpml_folder `xml:"Document>Folder"`
+}
+
+func is_wpml(dat []byte) bool {
+	return bytes.Contains(dat, []byte("<wpml:"))
+}
+
+// DJI WPML, either the executable waylines.wpml or the template.kml
+func read_wpml(dat []byte) *MultiMission {
+	var doc wpml_doc
+	if err := xml.Unmarshal(dat, &doc); err != nil {
+		fmt.Fprintf(os.Stderr, "WPML error: %v\n", err)
+		return nil
+	}
+	b := new_dji_builder("WPML")
+	for _, f := range doc.Folders {
+		hmode := f.ExecuteMode // waylines
+		if hmode == "" {
+			hmode = f.HeightMode // template
+		}
+		switch hmode {
+		case "WGS84", "EGM96":
+			b.amsl = true
+		case "aboveGroundLevel", "realTimeFollowSurface":
+			b.note("above ground altitudes flown as relative")
+		}
+		pms := f.Placemarks
+		sort.SliceStable(pms, func(i, j int) bool { return pms[i].Index < pms[j].Index })
+		for _, pm := range pms {
+			parts := strings.Split(strings.TrimSpace(pm.Coordinates), ",")
+			if len(parts) < 2 {
+				continue
+			}
+			lon, _ := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+			lat, _ := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			alt := pm.Height
+			if pm.ExecuteHeight != nil {
+				alt = *pm.ExecuteHeight
+			} else if pm.UseGlobalHeight == 1 {
+				alt = f.GlobalHeight
+			}
+			speed := pm.Speed
+			if pm.UseGlobalSpeed == 1 || speed == 0 {
+				speed = f.Speed
+			}
+			hp := pm.Heading
+			if pm.UseGlobalHead == 1 || hp.Mode == "" {
+				hp = f.GlobalHeading
+			}
+			switch hp.Mode {
+			case "fixed", "smoothTransition", "manually":
+				b.leg_head(hp.Angle, lat, lon)
+			case "towardPOI":
+				if p := strings.Split(hp.Poi, ","); len(p) >= 2 {
+					plat, _ := strconv.ParseFloat(strings.TrimSpace(p[0]), 64)
+					plon, _ := strconv.ParseFloat(strings.TrimSpace(p[1]), 64)
+					b.set_poi(plat, plon)
+				}
+			default: // followWayline
+				b.follow_path()
+			}
+			if pm.GimbalPitch != 0 || pm.GimbalHeadPitch != 0 {
+				b.note("gimbal pitch dropped")
+			}
+			hover := 0.0
+			uact := int16(0)
+			rotate := math.NaN()
+			for _, a := range pm.Actions {
+				switch a.Func {
+				case "hover":
+					hover += a.Param.HoverTime
+				case "takePhoto", "orientedShoot", "panoShot":
+					uact |= wp_USER1
+					b.note(a.Func + " approximated as user action 1")
+				case "rotateYaw":
+					rotate = a.Param.Heading
+				default:
+					b.note(a.Func + " dropped")
+				}
+			}
+			b.wp(lat, lon, alt, speed, hover, uact)
+			if !math.IsNaN(rotate) {
+				b.set_head(rotate)
+			}
+		}
+		if len(doc.Folders) > 1 {
+			b.note("only the first wayline used")
+			break
+		}
+	}
+	switch doc.FinishAction {
+	case "goHome":
+		b.add(MissionItem{Action: "RTH"})
+	case "autoLand":
+		b.add(MissionItem{Action: "RTH", P1: 1})
+	case "gotoFirstWaypoint":
+		b.note("finish action gotoFirstWaypoint dropped")
+	}
+	return b.mission()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// An aircraft of the fleet; file is empty for the default mission
+type FleetDevice struct {
+	device string
+	file   string
+}
+
+// Reads the device list, one "DEVICE [MISSION]" per line; '#' starts a
+// comment. Relative mission names are relative to the list file.
+func read_fleet_devices(path string) ([]FleetDevice, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	fds := []FleetDevice{}
+	scanner := bufio.NewScanner(fh)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if j := strings.Index(line, "#"); j != -1 {
+			line = line[:j]
+		}
+		parts := strings.Fields(line)
+		switch len(parts) {
+		case 0:
+			continue
+		case 1, 2:
+			fd := FleetDevice{device: parts[0]}
+			if len(parts) == 2 {
+				fd.file = parts[1]
+				if !filepath.IsAbs(fd.file) {
+					fd.file = filepath.Join(filepath.Dir(path), fd.file)
+				}
+			}
+			fds = append(fds, fd)
+		default:
+			return nil, fmt.Errorf("%s:%d: expected DEVICE [MISSION]", path, n)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(fds) == 0 {
+		return nil, fmt.Errorf("%s: no devices", path)
+	}
+	return fds, nil
+}
+
+// Writes complete lines to stderr, prefixed by the device; carriage return
+// progress updates are reduced to the final text of the line
+type PrefixWriter struct {
+	prefix string
+	buf    []byte
+}
+
+func (p *PrefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		j := bytes.IndexByte(p.buf, '\n')
+		if j == -1 {
+			break
+		}
+		line := p.buf[:j]
+		if k := bytes.LastIndexByte(line, '\r'); k != -1 {
+			line = line[k+1:]
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s\n", p.prefix, line)
+		p.buf = p.buf[j+1:]
+	}
+	return len(b), nil
+}
+
+func fleet_wps(r *Result) string {
+	if r.FC == nil {
+		return "-"
+	}
+	valid := "invalid"
+	if r.FC.WpValid == 1 {
+		valid = "valid"
+	}
+	if r.FC.WpMax == 0 { // MAVLink, items rather than WPs
+		return fmt.Sprintf("%d items %s", r.FC.WpCount, valid)
+	}
+	return fmt.Sprintf("%d/%d %s", r.FC.WpCount, r.FC.WpMax, valid)
+}
+
+func or_dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func fleet_summary(results []*Result) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tRESULT\tNAME\tBOARD\tVERSION\tMISSION\tFC WPS\tERROR")
+	for _, r := range results {
+		res := "ok"
+		if !r.Ok {
+			res = "FAIL"
+		}
+		name, board, vers := "-", "-", "-"
+		if r.FC != nil {
+			name, board, vers = or_dash(r.FC.Name), r.FC.Board, or_dash(r.FC.Version)
+		}
+		nwp := "-"
+		if r.Waypoints != nil {
+			nwp = fmt.Sprintf("%d", *r.Waypoints)
+		}
+		emsg, _, _ := strings.Cut(r.Error, "\n")
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Device, res, name, board, vers, nwp, fleet_wps(r), emsg)
+	}
+	tw.Flush()
+}
+
+// fleet -devices FILE upload|store [-verify] [MISSION]
+func do_fleet(devfile string, args []string, verify bool, jsonout bool) {
+	var eeprom bool
+	switch args[0] {
+	case "upload", "up":
+	case "store", "sto":
+		eeprom = true
+	default:
+		log.Printf("fleet: unknown action \"%s\" (upload or store)\n", args[0])
+		os.Exit(EXIT_USAGE)
+	}
+	if devfile == "" {
+		log.Println("fleet: -devices required")
+		os.Exit(EXIT_USAGE)
+	}
+	// An FC rebase or a single capture file cannot be shared by the fleet
+	if fc_rebase() || *capfile != "" {
+		log.Println("fleet: -rebase fc and -capture are not supported")
+		os.Exit(EXIT_USAGE)
+	}
+	fds, err := read_fleet_devices(devfile)
+	if err != nil {
+		log.Printf("fleet: %v\n", err)
+		os.Exit(EXIT_USAGE)
+	}
+	deffile := ""
+	if len(args) > 1 {
+		deffile = args[1]
+	}
+
+	// Missions and devices are checked before any FC is touched; each
+	// aircraft has its own copy of the mission, which upload modifies
+	type job struct {
+		devdesc DevDescription
+		m       *MultiMission
+		mtype   string
+	}
+	jobs := make([]job, len(fds))
+	results := make([]*Result, len(fds))
+	for j, fd := range fds {
+		file := fd.file
+		if file == "" {
+			file = deffile
+		}
+		if file == "" {
+			log.Printf("fleet: no mission for %s\n", fd.device)
+			os.Exit(EXIT_USAGE)
+		}
+		jobs[j].devdesc = parse_device(fd.device)
+		if jobs[j].devdesc.klass == DevClass_NONE {
+			log.Printf("fleet: invalid device \"%s\"\n", fd.device)
+			os.Exit(EXIT_USAGE)
+		}
+		jobs[j].mtype, jobs[j].m, err = Read_Mission_File(file)
+		if jobs[j].m == nil || err != nil {
+			log.Printf("fleet: invalid mission file %s\n", file)
+			os.Exit(EXIT_USAGE)
+		}
+		results[j] = NewResult("upload", false)
+		if eeprom {
+			results[j].Command = "store"
+		}
+		results[j].Device = fd.device
+		results[j].File = file
+		results[j].Type = jobs[j].mtype
+	}
+
+	open_capture()
+	var wg sync.WaitGroup
+	for j := range jobs {
+		wg.Add(1)
+		go func(jb job, r *Result) {
+			defer wg.Done()
+			r.timed("total", func() {
+				r.run_on(jb.devdesc, &PrefixWriter{prefix: r.Device}, func(s *MSPSerial) bool {
+					return r.upload(s, jb.m, jb.mtype, eeprom, verify)
+				}, func(mv *MAVLink) bool {
+					return r.upload_mavlink(mv, jb.m, jb.mtype, eeprom, verify)
+				})
+			})
+			r.Ok = r.status == EXIT_OK
+		}(jobs[j], results[j])
+	}
+	wg.Wait()
+
+	status := EXIT_OK
+	for _, r := range results {
+		if r.status > status {
+			status = r.status
+		}
+	}
+	if jsonout {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	} else {
+		fleet_summary(results)
+	}
+	os.Exit(status)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+import (
+	"geo"
+)
+
+// inav limits
+const (
+	MAX_SAFEHOMES = 8
+	MAX_GEOZONES  = 63
+	MAX_VERTICES  = 126
+)
+
+// inav safehome, for example from a QGC rally point
+type Safehome struct {
+	No      int     `xml:"no,attr" json:"no"`
+	Enabled bool    `xml:"enabled,attr" json:"enabled"`
+	Lat     float64 `xml:"lat,attr" json:"lat"`
+	Lon     float64 `xml:"lon,attr" json:"lon"`
+}
+
+type GeoVertex struct {
+	Lat float64 `xml:"lat,attr" json:"lat"`
+	Lon float64 `xml:"lon,attr" json:"lon"`
+}
+
+// inav geozone; a circle has a single vertex (the centre) and a radius (m).
+// Altitudes are in metres, 0 being unlimited
+type Geozone struct {
+	No       int         `xml:"no,attr" json:"no"`
+	Shape    string      `xml:"shape,attr" json:"shape"` // circle, polygon
+	Type     string      `xml:"type,attr" json:"type"`   // inclusive, exclusive
+	Minalt   int32       `xml:"minalt,attr" json:"minalt"`
+	Maxalt   int32       `xml:"maxalt,attr" json:"maxalt"`
+	Radius   float64     `xml:"radius,attr,omitempty" json:"radius,omitempty"`
+	Vertices []GeoVertex `xml:"vertex" json:"vertices"`
+}
+
+type qgc_fence struct {
+	Polygons []struct {
+		Inclusion bool        `json:"inclusion"`
+		Polygon   [][]float64 `json:"polygon"`
+	} `json:"polygons"`
+	Circles []struct {
+		Inclusion bool `json:"inclusion"`
+		Circle    struct {
+			Center []float64 `json:"center"`
+			Radius float64   `json:"radius"`
+		} `json:"circle"`
+	} `json:"circles"`
+}
+
+type qgc_rally struct {
+	Points [][]float64 `json:"points"`
+}
+
+func zone_type(inclusion bool) string {
+	if inclusion {
+		return "inclusive"
+	}
+	return "exclusive"
+}
+
+// QGC fence polygons and circles as geozones, within the inav limits
+func qgc_geozones(qf qgc_fence) []Geozone {
+	gzs := []Geozone{}
+	nv := 0
+	add := func(gz Geozone) {
+		if len(gzs) == MAX_GEOZONES || nv+len(gz.Vertices) > MAX_VERTICES {
+			fmt.Fprintf(os.Stderr, "QGC: geofence %s dropped (too many zones / vertices)\n", gz.Shape)
+			return
+		}
+		gz.No = len(gzs)
+		nv += len(gz.Vertices)
+		gzs = append(gzs, gz)
+	}
+	for _, p := range qf.Polygons {
+		gz := Geozone{Shape: "polygon", Type: zone_type(p.Inclusion)}
+		for _, v := range p.Polygon {
+			if len(v) >= 2 {
+				gz.Vertices = append(gz.Vertices, GeoVertex{v[0], v[1]})
+			}
+		}
+		if len(gz.Vertices) < 3 {
+			fmt.Fprintln(os.Stderr, "QGC: geofence polygon with fewer than 3 vertices dropped")
+			continue
+		}
+		add(gz)
+	}
+	for _, c := range qf.Circles {
+		if len(c.Circle.Center) < 2 || c.Circle.Radius <= 0 {
+			continue
+		}
+		gz := Geozone{Shape: "circle", Type: zone_type(c.Inclusion), Radius: c.Circle.Radius,
+			Vertices: []GeoVertex{{c.Circle.Center[0], c.Circle.Center[1]}}}
+		add(gz)
+	}
+	return gzs
+}
+
+// QGC rally points as safehomes, within the inav limit
+func qgc_safehomes(qr qgc_rally) []Safehome {
+	shs := []Safehome{}
+	for _, p := range qr.Points {
+		if len(p) < 2 {
+			continue
+		}
+		if len(shs) == MAX_SAFEHOMES {
+			fmt.Fprintf(os.Stderr, "QGC: %d rally points dropped (%d safehomes max)\n", len(qr.Points)-MAX_SAFEHOMES, MAX_SAFEHOMES)
+			break
+		}
+		shs = append(shs, Safehome{No: len(shs), Enabled: true, Lat: p[0], Lon: p[1]})
+	}
+	return shs
+}
+
+// Moves safehomes and geozones with a rebased mission
+func (mm *MultiMission) rebase_areas(blat0, blon0, blat, blon float64) {
+	move := func(lat, lon float64) (float64, float64) {
+		brg, rng := geo.Csedist(blat0, blon0, lat, lon)
+		return geo.Posit(blat, blon, brg, rng)
+	}
+	for j := range mm.Safehomes {
+		mm.Safehomes[j].Lat, mm.Safehomes[j].Lon = move(mm.Safehomes[j].Lat, mm.Safehomes[j].Lon)
+	}
+	for j := range mm.Geozones {
+		for k := range mm.Geozones[j].Vertices {
+			v := &mm.Geozones[j].Vertices[k]
+			v.Lat, v.Lon = move(v.Lat, v.Lon)
+		}
+	}
+}
+
+// safehome <index> <enabled> <lat> <lon>
+// geozone <id> <shape> <type> <minalt> <maxalt> <sealevel> <action> <vertices>
+// geozone vertex <id> <index> <lat> <lon>
+func (mm *MultiMission) cli_areas(w io.Writer) {
+	if len(mm.Safehomes) > 0 {
+		fmt.Fprintln(w, "# safehome")
+	}
+	for _, sh := range mm.Safehomes {
+		ena := 0
+		if sh.Enabled {
+			ena = 1
+		}
+		fmt.Fprintf(w, "safehome %d %d %d %d\n", sh.No, ena, int(sh.Lat*1e7), int(sh.Lon*1e7))
+	}
+	if len(mm.Geozones) > 0 {
+		fmt.Fprintln(w, "# geozone")
+	}
+	for _, gz := range mm.Geozones {
+		shape, typ, nv := 1, 0, len(gz.Vertices)
+		if gz.Shape == "circle" {
+			shape, nv = 0, 2
+		}
+		if gz.Type == "inclusive" {
+			typ = 1
+		}
+		fmt.Fprintf(w, "geozone %d %d %d %d %d 0 0 %d\n", gz.No, shape, typ, gz.Minalt*100, gz.Maxalt*100, nv)
+		for k, v := range gz.Vertices {
+			fmt.Fprintf(w, "geozone vertex %d %d %d %d\n", gz.No, k, int(v.Lat*1e7), int(v.Lon*1e7))
+		}
+		if gz.Shape == "circle" { // the radius (cm) is the second vertex
+			fmt.Fprintf(w, "geozone vertex %d 1 %d 0\n", gz.No, int(gz.Radius*100))
+		}
+	}
+}
+
+// Collects the safehome and geozone CLI lines (as fields); unused (default)
+// safehomes are ignored
+type cli_area_reader struct {
+	shs []Safehome
+	gzs []Geozone
+}
+
+func (c *cli_area_reader) parse(f []string) {
+	iv := make([]int, len(f))
+	for j := 1; j < len(f); j++ {
+		iv[j], _ = strconv.Atoi(f[j])
+	}
+	switch {
+	case f[0] == "safehome" && len(f) >= 5:
+		if iv[2] == 0 && iv[3] == 0 && iv[4] == 0 {
+			return
+		}
+		c.shs = append(c.shs, Safehome{No: iv[1], Enabled: iv[2] == 1,
+			Lat: float64(iv[3]) / 1e7, Lon: float64(iv[4]) / 1e7})
+	case f[0] == "geozone" && len(f) == 6 && f[1] == "vertex":
+		for j := range c.gzs {
+			gz := &c.gzs[j]
+			if gz.No != iv[2] {
+				continue
+			}
+			if gz.Shape == "circle" && iv[3] == 1 { // radius (cm)
+				gz.Radius = float64(iv[4]) / 100
+			} else {
+				gz.Vertices = append(gz.Vertices, GeoVertex{float64(iv[4]) / 1e7, float64(iv[5]) / 1e7})
+			}
+		}
+	case f[0] == "geozone" && len(f) >= 8:
+		gz := Geozone{No: iv[1], Shape: "polygon", Type: zone_type(iv[3] == 1),
+			Minalt: int32(iv[4] / 100), Maxalt: int32(iv[5] / 100)}
+		if iv[2] == 0 {
+			gz.Shape = "circle"
+		}
+		c.gzs = append(c.gzs, gz)
+	}
+}
+
+func (mm *MultiMission) md_areas(w io.Writer) {
+	if len(mm.Safehomes) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "### Safehomes")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "| # | Enabled | Lat | Lon |")
+		fmt.Fprintln(w, "| ---- | ---- | ---- | ---- |")
+		for _, sh := range mm.Safehomes {
+			fmt.Fprintf(w, "| %d | %v | %.7f | %.7f |\n", sh.No, sh.Enabled, sh.Lat, sh.Lon)
+		}
+	}
+	if len(mm.Geozones) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "### Geozones")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "| # | Shape | Type | Min Alt | Max Alt | Radius | Vertices |")
+		fmt.Fprintln(w, "| ---- | ---- | ---- | ---- | ---- | ---- | ---- |")
+		for _, gz := range mm.Geozones {
+			fmt.Fprintf(w, "| %d | %s | %s | %d | %d | %.0f | %d |\n", gz.No, gz.Shape, gz.Type, gz.Minalt, gz.Maxalt, gz.Radius, len(gz.Vertices))
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -18,20 +19,22 @@ const (
 	DevClass_TCP
 	DevClass_UDP
 	DevClass_BT
+	DevClass_REPLAY
 )
 
 const INAV_MAX_WP = 255
 
 type DevDescription struct {
-	klass  int
-	name   string
-	param  int
-	name1  string
-	param1 int
+	klass   int
+	name    string
+	param   int
+	name1   string
+	param1  int
+	mavlink bool
 }
 
 var (
-	rebase     = flag.String("rebase", "", "rebase 1st WP to location (as lat,lon[,wpno,segno)")
+	rebase     = flag.String("rebase", "", "rebase 1st WP to location (as lat,lon[,wpno,segno] or fc[,wpno,segno])")
 	defalt     = flag.Int("a", 20, "Default altitude (m)")
 	baud       = flag.Int("b", 115200, "Baud rate")
 	device     = flag.String("d", "", "Serial Device")
@@ -39,10 +42,15 @@ var (
 	force_rtl  = flag.Bool("force-rth", false, "Adds RTH for 'external' formats")
 	force_land = flag.Bool("force-land", false, "Adds RTH / Land for 'external' formats")
 	show_vers  = flag.Bool("v", false, "Shows version")
-	outfmt     = flag.String("fmt", "xml", "Output format (xml, json, md, cli, xml-ugly)")
+	outfmt     = flag.String("fmt", "xml", "Output format (xml, json, md, cli, svg, png, xml-ugly)")
 	verbose    = flag.Bool("verbose", false, "Verbose")
-
-	MaxWP = 120
+	capfile    = flag.String("capture", "", "Capture MSP traffic to file")
+	save       = flag.Bool("save", false, "Save settings / segment changes to EEPROM")
+	cfgfile    = flag.String("config", "", "Configuration file (default ~/.config/impload/config.toml)")
+	pname      = flag.String("profile", "", "Aircraft profile from the configuration file")
+	simplify   = flag.Float64("simplify", 5, "Simplification tolerance (m) for recorded tracks")
+	gpxtrack   = flag.Bool("track", false, "Converts timed GPX tracks as recorded flights")
+	via        = flag.String("via", "msp", "Mission upload path (msp, cli)")
 )
 
 var GitCommit = "local"
@@ -52,23 +60,70 @@ func GetVersion() string {
 	return fmt.Sprintf("impload %s, commit: %s", GitTag, GitCommit)
 }
 
-func do_test() {
+func do_test(jsonout bool) {
+	r := NewResult("test", jsonout)
+	r.run_link(func(s *MSPSerial) bool { return true },
+		func(mv *MAVLink) bool { return true })
+	r.exit()
+}
+
+func do_home() {
 	devdesc := check_device()
-	MSPInit(devdesc)
+	s := MSPInit(devdesc)
+	g := s.get_gps()
+	fmt.Fprintf(os.Stderr, "GPS: fix %d, sats %d, hdop %.2f, %.7f %.7f %dm\n", g.fix, g.nsat, float64(g.hdop)/100.0, g.lat, g.lon, g.alt)
+	if lat, lon, ok := s.get_home(); ok {
+		fmt.Fprintf(os.Stderr, "Home: %.7f %.7f\n", lat, lon)
+	} else {
+		fmt.Fprintln(os.Stderr, "Home: not set")
+	}
+}
+
+// An "fc[,wpno,segno]" rebase, to the FC location
+func fc_rebase() bool {
+	return *rebase == "fc" || strings.HasPrefix(*rebase, "fc,")
+}
+
+// The -rebase location, unless it is the FC's (see resolve_fc_rebase)
+func given_rebase() string {
+	if fc_rebase() {
+		return ""
+	}
+	return *rebase
+}
+
+// Returns the -rebase location, with "fc" replaced by the FC location,
+// opening the FC if necessary
+func resolve_fc_rebase(s *MSPSerial) string {
+	if !fc_rebase() {
+		return *rebase
+	}
+	if s == nil {
+		s = MSPInit(check_device())
+	}
+	lat, lon, err := s.fc_location()
+	if err != nil {
+		log.Fatalf("Rebase from FC: %v\n", err)
+	}
+	return fmt.Sprintf("%.7f,%.7f%s", lat, lon, (*rebase)[2:])
 }
 
 func do_convert(inf string, outf string) {
+	rb := resolve_fc_rebase(nil)
 	mtype, m, err := Read_Mission_File(inf)
 	if m != nil && err == nil {
+		m.Update_mission_meta(rb)
 		//		sanitise_mission(m, mtype)
 		m.Dump(*outfmt, outf, inf, mtype)
 	} else {
-		log.Fatal("Invalid input file\n")
+		log.Println("Invalid input file")
+		os.Exit(EXIT_USAGE)
 	}
 }
 
 func sanitise_mission(mm *MultiMission, mtype string) {
-	for _, m := range mm.Segment {
+	for i := range mm.Segment {
+		m := &mm.Segment[i]
 		for j, mi := range m.MissionItems {
 			if mi.Action == "WAYPOINT" {
 				if *defspeed != 0.0 && mi.P1 == 0 {
@@ -79,7 +134,7 @@ func sanitise_mission(mm *MultiMission, mtype string) {
 				}
 			}
 		}
-		if (mtype == "gpx" || mtype == "kml") && (*force_rtl || *force_land) {
+		if (mtype == "gpx" || mtype == "kml" || mtype == "blackbox" || mtype == "igc" || mtype == "nmea") && (*force_rtl || *force_land) {
 			m.Add_rtl(*force_land)
 		}
 	}
@@ -87,6 +142,10 @@ func sanitise_mission(mm *MultiMission, mtype string) {
 
 func do_clear(eeprom bool) {
 	devdesc := check_device()
+	if devdesc.mavlink {
+		do_clear_mavlink(devdesc)
+		return
+	}
 	s := MSPInit(devdesc)
 	mis := []MissionItem{}
 	item := MissionItem{No: 1, Lat: 0.0, Lon: 0.0, Alt: int32(25), Action: "RTH", Flag: 0xa5}
@@ -95,35 +154,197 @@ func do_clear(eeprom bool) {
 	s.upload(mm, eeprom)
 }
 
-func do_upload(inf string, eeprom bool) {
-	devdesc := check_device()
-	s := MSPInit(devdesc)
+func do_upload(inf string, eeprom bool, verify bool, jsonout bool) {
+	r := NewResult("upload", jsonout)
+	if eeprom {
+		r.Command = "store"
+	}
+	r.File = inf
 	mtype, m, err := Read_Mission_File(inf)
-	if m != nil && err == nil {
-		sanitise_mission(m, mtype)
-		s.upload(m, eeprom)
-	} else {
-		log.Fatal("Invalid input file\n")
+	if m == nil || err != nil {
+		r.fail(EXIT_USAGE, "Invalid input file")
+		r.exit()
 	}
+	r.Type = mtype
+	r.run_link(func(s *MSPSerial) bool {
+		return r.upload(s, m, mtype, eeprom, verify)
+	}, func(mv *MAVLink) bool {
+		return r.upload_mavlink(mv, m, mtype, eeprom, verify)
+	})
+	r.exit()
 }
 
-func do_download(outf string, eeprom bool) {
-	devdesc := check_device()
-	s := MSPInit(devdesc)
-	m := s.download(eeprom)
-	m.Dump(*outfmt, outf)
+// Uploads (and optionally verifies) the mission, recording the outcome
+func (r *Result) upload(s *MSPSerial, m *MultiMission, mtype string, eeprom bool, verify bool) bool {
+	var err error
+	r.timed("upload", func() { err = s.upload_mission(m, mtype, eeprom) })
+	r.set_mission(m)
+	if err != nil {
+		r.fail(EXIT_FAIL, "%v", err)
+		return false
+	}
+	r.Saved = eeprom || s.cliwp != nil
+	s.wp_info()
+	if verify {
+		var d *MissionDiff
+		r.timed("verify", func() { d = Diff_missions(m, s.download(false), false) })
+		ok := len(d.lines) == 0
+		r.Verified = &ok
+		r.Differences = d.lines
+		if !ok {
+			r.fail(EXIT_FAIL, "Verify failed:\n%s", strings.Join(d.lines, "\n"))
+			return false
+		}
+		s.printf("Verified\n")
+	}
+	return true
 }
 
-func do_get_multi_index() {
+// Uploads a mission with its settings, restoring the settings if the
+// upload fails. A CLI upload ends with the FC rebooting, which saves the
+// settings, or discards them on failure.
+func (s *MSPSerial) upload_mission(m *MultiMission, mtype string, eeprom bool) error {
+	sanitise_mission(m, mtype)
+	if *rebase != "" {
+		rb := resolve_fc_rebase(s)
+		m.Update_mission_meta(rb)
+	}
+	if !m.valid_for(s.info.WpMax) {
+		return fmt.Errorf("Mission fails verification: %s", strings.Join(m.validate(s.info.WpMax), "; "))
+	}
+	changes, err := s.prepare_settings(m.Settings)
+	if err != nil {
+		return fmt.Errorf("Mission settings: %v", err)
+	}
+	if len(changes) > 0 {
+		s.printf("Mission settings:\n")
+		s.show_setting_changes(changes)
+		if err = s.apply_settings(changes); err != nil {
+			s.rollback_settings(changes)
+			return fmt.Errorf("Mission settings: %v", err)
+		}
+	}
+	if !s.upload(m, eeprom) {
+		if len(changes) > 0 && !s.cli.Load() {
+			s.rollback_settings(changes)
+		}
+		return errors.New("Mission upload failed")
+	}
+	if len(changes) > 0 && (eeprom || *save) && !s.cli.Load() {
+		s.save_settings()
+	}
+	return nil
+}
+
+// With -json, a mission written to stdout is included in the JSON result
+func do_download(outf string, eeprom bool, jsonout bool) {
+	r := NewResult("download", jsonout)
+	if eeprom {
+		r.Command = "restore"
+	}
+	output := func(m *MultiMission) bool {
+		r.set_mission(m)
+		if jsonout && outf == "-" {
+			m.Update_mission_meta(given_rebase())
+			r.Mission = m
+		} else {
+			r.File = outf
+			m.Dump(*outfmt, outf)
+		}
+		return true
+	}
+	r.run_link(func(s *MSPSerial) bool {
+		var m *MultiMission
+		r.timed("download", func() { m = s.download(eeprom) })
+		return output(m)
+	}, func(mv *MAVLink) bool {
+		// Autopilots keep the mission in non-volatile storage, so restore
+		// is a download
+		var m *MultiMission
+		r.timed("download", func() { m = mv.download_mission() })
+		return output(m)
+	})
+	r.exit()
+}
+
+// Gets, or if idx >= 0 sets (and saves), the multi-mission index
+func do_multi(idx int, jsonout bool) {
+	r := NewResult("multi", jsonout)
+	r.run_fc(func(s *MSPSerial) bool {
+		if idx >= 0 {
+			if _, err := s.set_setting(SETTING_STR, strconv.Itoa(idx)); err != nil {
+				r.fail(EXIT_FAIL, "%v", err)
+				return false
+			}
+			s.save_settings()
+		}
+		si, err := s.get_setting_info(SETTING_STR)
+		if err != nil {
+			r.fail(EXIT_FAIL, "%v", err)
+			return false
+		}
+		n, _ := strconv.Atoi(si.format_value())
+		r.MultiIndex = &n
+		fmt.Fprintf(os.Stderr, "Multi index %d\n", n)
+		return true
+	})
+	r.exit()
+}
+
+func do_get_settings(names []string) {
 	devdesc := check_device()
 	s := MSPInit(devdesc)
-	s.get_multi_index()
+	for _, name := range names {
+		si, err := s.get_setting_info(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "get: %v\n", err)
+			continue
+		}
+		fmt.Printf("set %s = %s\n", si.Name, si.format_value())
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "  type %s, range %s\n", si.type_name(), si.range_str())
+		}
+	}
 }
 
-func do_set_multi_index(mval int) {
+// Settings are given as name=value, or as files of settings (including
+// inav cli diffs)
+func do_set_settings(args []string) {
+	svs := []SettingValue{}
+	for _, a := range args {
+		if sv, ok := parse_setting_line(a); ok {
+			svs = append(svs, sv)
+		} else {
+			dat, err := os.ReadFile(a)
+			if err != nil {
+				log.Printf("set: %v\n", err)
+				os.Exit(EXIT_USAGE)
+			}
+			svs = append(svs, parse_setting_lines(dat)...)
+		}
+	}
+	if len(svs) == 0 {
+		log.Println("set: name=value or settings file required")
+		os.Exit(EXIT_USAGE)
+	}
 	devdesc := check_device()
 	s := MSPInit(devdesc)
-	s.set_multi_index(uint8(mval))
+	nerr := 0
+	for _, sv := range svs {
+		si, err := s.set_setting(sv.Name, sv.Value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "set: %v\n", err)
+			nerr++
+		} else {
+			fmt.Fprintf(os.Stderr, "set %s = %s\n", si.Name, si.format_value())
+		}
+	}
+	if *save {
+		s.save_settings()
+	}
+	if nerr > 0 {
+		os.Exit(EXIT_FAIL)
+	}
 }
 
 func verify_in_out_files(files []string) (string, string) {
@@ -141,7 +362,7 @@ func verify_in_out_files(files []string) (string, string) {
 	return inf, outf
 }
 
-func check_device() DevDescription {
+func find_device() (DevDescription, error) {
 	devdesc := parse_device(*device)
 	if devdesc.klass == DevClass_NONE {
 		if v, err := enumerate_ports(); err == nil {
@@ -153,9 +374,17 @@ func check_device() DevDescription {
 	}
 
 	if devdesc.klass == DevClass_NONE {
-		log.Fatalln("No device available")
-	} else {
-		log.Printf("Using device [%v]\n", *device)
+		return devdesc, errors.New("No device available")
+	}
+	log.Printf("Using device [%v]\n", *device)
+	return devdesc, nil
+}
+
+func check_device() DevDescription {
+	devdesc, err := find_device()
+	if err != nil {
+		log.Println(err)
+		os.Exit(EXIT_FC)
 	}
 	return devdesc
 }
@@ -165,7 +394,7 @@ func resolve_default_gw() string {
 		"route -n | grep UG | awk '{print $2}'",
 		"route -n show  0.0.0.0 | grep gateway | awk '{print $2}'"}
 
-	ostr := os.Getenv("MWP_SERIAL_HOST")
+	ostr := serial_host()
 	if ostr != "" {
 		return ostr
 	}
@@ -199,6 +428,11 @@ func splithost(uhost string) (string, int) {
 
 func parse_device(devstr string) DevDescription {
 	dd := DevDescription{name: "", klass: DevClass_NONE}
+	// "mavlink:" selects the MAVLink mission protocol rather than MSP
+	if strings.HasPrefix(devstr, "mavlink:") {
+		devstr = devstr[8:]
+		dd.mavlink = true
+	}
 	if devstr == "" {
 		return dd
 	}
@@ -206,6 +440,9 @@ func parse_device(devstr string) DevDescription {
 	if len(devstr) == 17 && (devstr)[2] == ':' && (devstr)[8] == ':' && (devstr)[14] == ':' {
 		dd.name = devstr
 		dd.klass = DevClass_BT
+	} else if strings.HasPrefix(devstr, "replay://") {
+		dd.name = devstr[9:]
+		dd.klass = DevClass_REPLAY
 	} else {
 		u, err := url.Parse(devstr)
 		if err == nil {
@@ -222,7 +459,7 @@ func parse_device(devstr string) DevDescription {
 				if len(ss) > 1 {
 					dd.param, _ = strconv.Atoi(ss[1])
 				} else {
-					dd.param = 115200
+					dd.param = *baud
 				}
 			} else {
 				if u.RawQuery != "" {
@@ -252,63 +489,18 @@ func parse_device(devstr string) DevDescription {
 	return dd
 }
 func main() {
-
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of impload [options] command [files ...]\n")
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "  command:\n\tAction required (upload|download|store|restore|convert|test|clear|erase|multi[=n])\n\n")
-		fmt.Fprintln(os.Stderr, GetVersion())
-	}
-
+	flag.Usage = main_usage
 	flag.Parse()
 
 	if *show_vers {
 		fmt.Fprintf(os.Stderr, "%s\n", GitTag)
-		os.Exit(0)
-	}
-
-	files := flag.Args()
-	if len(files) == 0 {
-		flag.Usage()
-		os.Exit(-1)
+		os.Exit(EXIT_OK)
 	}
 
-	inf, outf := verify_in_out_files(files[1:])
-
-	switch files[0] {
-	case "help":
+	args := flag.Args()
+	if len(args) == 0 {
 		flag.Usage()
-		os.Exit(0)
-	case "test":
-		do_test()
-	case "upload", "up":
-		do_upload(inf, false)
-	case "download", "down":
-		do_download(inf, false)
-	case "convert", "conv":
-		do_convert(inf, outf)
-	case "store", "sto":
-		do_upload(inf, true)
-	case "restore", "rest":
-		do_download(inf, true)
-	case "clear", "erase":
-		do_clear(files[0] == "erase")
-	case "multi":
-		do_get_multi_index()
-	case "version":
-		fmt.Fprintln(os.Stderr, GetVersion())
-	default:
-		if strings.HasPrefix(files[0], "multi=") {
-			mparts := strings.Split(files[0], "=")
-			if len(mparts) == 2 {
-				mval, err := strconv.Atoi(mparts[1])
-				if err == nil && mval >= 0 && mval < 10 {
-					do_set_multi_index(mval)
-				}
-			}
-		} else {
-			fmt.Fprintf(os.Stderr, "impload: unrecognised command \"%s\"\n", files[0])
-		}
+		os.Exit(EXIT_USAGE)
 	}
+	run_command(args[0], args[1:])
 }
@@ -0,0 +1,822 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// MAVLink (v2, v1 is also read) mission protocol, for uploading missions
+// to and downloading missions from ArduPilot and PX4 autopilots. A device
+// name prefixed by "mavlink:" selects MAVLink rather than MSP.
+
+const (
+	mav_STX_V1 = 0xfe
+	mav_STX_V2 = 0xfd
+
+	mav_SYSID  = 255 // GCS
+	mav_COMPID = 190 // MAV_COMP_ID_MISSIONPLANNER
+
+	mav_TIMEOUT = 1500 * time.Millisecond
+	mav_RETRIES = 5
+)
+
+const (
+	mavmsg_HEARTBEAT            = 0
+	mavmsg_MISSION_REQUEST      = 40
+	mavmsg_MISSION_REQUEST_LIST = 43
+	mavmsg_MISSION_COUNT        = 44
+	mavmsg_MISSION_CLEAR_ALL    = 45
+	mavmsg_MISSION_ACK          = 47
+	mavmsg_MISSION_REQUEST_INT  = 51
+	mavmsg_MISSION_ITEM_INT     = 73
+	mavmsg_STATUSTEXT           = 253
+)
+
+// CRC extra and (extended) payload length of the messages used; other
+// messages are ignored
+var mav_msgs = map[uint32]struct {
+	extra byte
+	len   int
+}{
+	mavmsg_HEARTBEAT:            {50, 9},
+	mavmsg_MISSION_REQUEST:      {230, 5},
+	mavmsg_MISSION_REQUEST_LIST: {132, 3},
+	mavmsg_MISSION_COUNT:        {221, 9},
+	mavmsg_MISSION_CLEAR_ALL:    {232, 3},
+	mavmsg_MISSION_ACK:          {153, 8},
+	mavmsg_MISSION_REQUEST_INT:  {196, 5},
+	mavmsg_MISSION_ITEM_INT:     {38, 38},
+	mavmsg_STATUSTEXT:           {83, 54},
+}
+
+const (
+	mavcmd_NAV_WAYPOINT         = 16
+	mavcmd_NAV_LOITER_UNLIM     = 17
+	mavcmd_NAV_LOITER_TURNS     = 18
+	mavcmd_NAV_LOITER_TIME      = 19
+	mavcmd_NAV_RETURN_TO_LAUNCH = 20
+	mavcmd_NAV_LAND             = 21
+	mavcmd_NAV_TAKEOFF          = 22
+	mavcmd_CONDITION_YAW        = 115
+	mavcmd_DO_JUMP              = 177
+	mavcmd_DO_CHANGE_SPEED      = 178
+	mavcmd_DO_SET_SERVO         = 183
+	mavcmd_DO_LAND_START        = 189
+	mavcmd_DO_SET_ROI_LOCATION  = 195
+	mavcmd_DO_SET_ROI_NONE      = 197
+	mavcmd_DO_SET_ROI           = 201
+	mavcmd_DO_DIGICAM_CONTROL   = 203
+)
+
+const (
+	mavframe_GLOBAL                  = 0
+	mavframe_MISSION                 = 2
+	mavframe_GLOBAL_RELATIVE_ALT     = 3
+	mavframe_GLOBAL_INT              = 5
+	mavframe_GLOBAL_RELATIVE_ALT_INT = 6
+	mavframe_GLOBAL_TERRAIN_ALT      = 10
+	mavframe_GLOBAL_TERRAIN_ALT_INT  = 11
+)
+
+const (
+	mavap_INVALID   = 8
+	mavap_ARDUPILOT = 3
+	mavap_PX4       = 12
+
+	mavtype_GCS = 6
+)
+
+type MavMsg struct {
+	sysid  byte
+	compid byte
+	msgid  uint32
+	data   []byte
+}
+
+// A mission item (MISSION_ITEM_INT)
+type MavItem struct {
+	seq     int
+	command uint16
+	frame   byte
+	params  [4]float32
+	lat     float64
+	lon     float64
+	alt     float32
+}
+
+type MAVLink struct {
+	sd        SerDev
+	rx        chan MavMsg
+	seq       byte
+	sysid     byte // target
+	compid    byte
+	autopilot byte
+	info      FCInfo
+	msgs      io.Writer // progress messages (stderr if nil)
+}
+
+var mav_results = []string{"accepted", "error", "unsupported frame", "unsupported command",
+	"no space", "invalid", "invalid param1", "invalid param2", "invalid param3", "invalid param4",
+	"invalid x", "invalid y", "invalid z", "invalid sequence", "denied", "operation cancelled"}
+
+func mav_result(t byte) string {
+	if int(t) < len(mav_results) {
+		return mav_results[t]
+	}
+	return fmt.Sprintf("result %d", t)
+}
+
+func mav_autopilot(ap byte) string {
+	switch ap {
+	case mavap_ARDUPILOT:
+		return "ArduPilot"
+	case mavap_PX4:
+		return "PX4"
+	default:
+		return fmt.Sprintf("MAVLink autopilot %d", ap)
+	}
+}
+
+func mav_vehicle(t byte) string {
+	switch t {
+	case 1:
+		return "fixed wing"
+	case 2:
+		return "quadcopter"
+	case 4:
+		return "helicopter"
+	case 10:
+		return "rover"
+	case 13:
+		return "hexacopter"
+	case 14:
+		return "octocopter"
+	case 15:
+		return "tricopter"
+	}
+	if t >= 19 && t <= 25 {
+		return "VTOL"
+	}
+	return fmt.Sprintf("vehicle type %d", t)
+}
+
+func crc_x25(crc uint16, b byte) uint16 {
+	tmp := b ^ byte(crc&0xff)
+	tmp ^= tmp << 4
+	return (crc >> 8) ^ (uint16(tmp) << 8) ^ (uint16(tmp) << 3) ^ (uint16(tmp) >> 4)
+}
+
+func encode_mavlink(seq byte, msgid uint32, payload []byte) []byte {
+	// MAVLink 2 truncates trailing zero bytes (but not the first byte)
+	n := len(payload)
+	for n > 1 && payload[n-1] == 0 {
+		n--
+	}
+	buf := make([]byte, 0, n+12)
+	buf = append(buf, mav_STX_V2, byte(n), 0, 0, seq, mav_SYSID, mav_COMPID, byte(msgid), byte(msgid>>8), byte(msgid>>16))
+	buf = append(buf, payload[:n]...)
+	crc := uint16(0xffff)
+	for _, b := range buf[1:] {
+		crc = crc_x25(crc, b)
+	}
+	crc = crc_x25(crc, mav_msgs[msgid].extra)
+	return append(buf, byte(crc), byte(crc>>8))
+}
+
+// Decodes the first frame in buf, returning the message (nil for junk,
+// unknown messages or CRC errors) and the bytes consumed; zero consumed
+// means more data is needed.
+func decode_mavlink(buf []byte) (*MavMsg, int) {
+	j := 0
+	for j < len(buf) && buf[j] != mav_STX_V1 && buf[j] != mav_STX_V2 {
+		j++
+	}
+	if j > 0 {
+		return nil, j
+	}
+	if len(buf) < 2 {
+		return nil, 0
+	}
+	plen := int(buf[1])
+	var hlen, flen int
+	var msg MavMsg
+	if buf[0] == mav_STX_V2 {
+		hlen = 10
+		if len(buf) < hlen {
+			return nil, 0
+		}
+		flen = hlen + plen + 2
+		if buf[2]&1 != 0 { // signed
+			flen += 13
+		}
+		msg = MavMsg{sysid: buf[5], compid: buf[6], msgid: uint32(buf[7]) | uint32(buf[8])<<8 | uint32(buf[9])<<16}
+	} else {
+		hlen = 6
+		if len(buf) < hlen {
+			return nil, 0
+		}
+		flen = hlen + plen + 2
+		msg = MavMsg{sysid: buf[3], compid: buf[4], msgid: uint32(buf[5])}
+	}
+	if len(buf) < flen {
+		return nil, 0
+	}
+	mi, ok := mav_msgs[msg.msgid]
+	if !ok {
+		return nil, flen
+	}
+	crc := uint16(0xffff)
+	for _, b := range buf[1 : hlen+plen] {
+		crc = crc_x25(crc, b)
+	}
+	crc = crc_x25(crc, mi.extra)
+	if crc != binary.LittleEndian.Uint16(buf[hlen+plen:]) {
+		return nil, 1
+	}
+	// Truncated payloads are zero filled
+	n := mi.len
+	if plen > n {
+		n = plen
+	}
+	msg.data = make([]byte, n)
+	copy(msg.data, buf[hlen:hlen+plen])
+	return &msg, flen
+}
+
+// A UDP socket listening for the vehicle, which replies to the last sender
+type UDPPeer struct {
+	conn *net.UDPConn
+	peer *net.UDPAddr
+}
+
+func (u *UDPPeer) Read(buf []byte) (int, error) {
+	n, addr, err := u.conn.ReadFromUDP(buf)
+	if err == nil {
+		u.peer = addr
+	}
+	return n, err
+}
+
+func (u *UDPPeer) Write(buf []byte) (int, error) {
+	if u.peer == nil {
+		return len(buf), nil
+	}
+	return u.conn.WriteToUDP(buf, u.peer)
+}
+
+func (u *UDPPeer) Close() error {
+	return u.conn.Close()
+}
+
+func NewMAVLink(dd DevDescription) (*MAVLink, error) {
+	var sd SerDev
+	if dd.klass == DevClass_UDP && dd.name == "" && dd.param1 == 0 {
+		// udp://:port, the usual GCS listener, e.g. udp://:14550
+		laddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", dd.param))
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return nil, err
+		}
+		sd = &UDPPeer{conn: conn}
+	} else {
+		// The MSP device setup opens the link; only the transport is used
+		m, err := NewMSPSerial(dd)
+		if err != nil {
+			return nil, err
+		}
+		sd = m.sd
+	}
+	return &MAVLink{sd: sd, rx: make(chan MavMsg, 16)}, nil
+}
+
+func (mv *MAVLink) printf(format string, a ...interface{}) {
+	if mv.msgs != nil {
+		fmt.Fprintf(mv.msgs, format, a...)
+	} else {
+		fmt.Fprintf(os.Stderr, format, a...)
+	}
+}
+
+// Link failures panic (as a recoverable MSP session)
+func (mv *MAVLink) fatal(msg string) {
+	panic(MSPError("MAVLink: " + msg))
+}
+
+func (mv *MAVLink) reader() {
+	inp := make([]byte, 2048)
+	buf := []byte{}
+	for {
+		n, err := mv.sd.Read(inp)
+		if err != nil {
+			close(mv.rx)
+			return
+		}
+		if n == 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		buf = append(buf, inp[:n]...)
+		for {
+			msg, used := decode_mavlink(buf)
+			if used == 0 {
+				break
+			}
+			buf = buf[used:]
+			if msg != nil {
+				select {
+				case mv.rx <- *msg:
+				default: // not being read, e.g. heartbeats between operations
+				}
+			}
+		}
+	}
+}
+
+func (mv *MAVLink) send(msgid uint32, payload []byte) {
+	buf := encode_mavlink(mv.seq, msgid, payload)
+	mv.seq++
+	if _, err := mv.sd.Write(buf); err != nil {
+		mv.fatal(err.Error())
+	}
+}
+
+// Waits for one of the messages from the target; false on timeout
+func (mv *MAVLink) wait(timeout time.Duration, ids ...uint32) (MavMsg, bool) {
+	tm := time.After(timeout)
+	for {
+		select {
+		case msg, ok := <-mv.rx:
+			if !ok {
+				mv.fatal("device closed")
+			}
+			if msg.msgid == mavmsg_STATUSTEXT {
+				mv.printf("%s: %s\n", mav_autopilot(mv.autopilot), strings.TrimRight(string(msg.data[1:51]), "\x00"))
+				continue
+			}
+			if msg.sysid != mv.sysid {
+				continue
+			}
+			for _, id := range ids {
+				if msg.msgid == id {
+					return msg, true
+				}
+			}
+		case <-tm:
+			return MavMsg{}, false
+		}
+	}
+}
+
+func (mv *MAVLink) heartbeat() {
+	b := make([]byte, 9)
+	b[4] = mavtype_GCS
+	b[5] = mavap_INVALID
+	b[8] = 3
+	mv.send(mavmsg_HEARTBEAT, b)
+}
+
+// Waits for an autopilot's heartbeat, which identifies the target
+func (mv *MAVLink) Init() {
+	go mv.reader()
+	for j := 0; j < mav_RETRIES; j++ {
+		// Some links (e.g. UDP) only pass data once the GCS has spoken
+		mv.heartbeat()
+		tm := time.After(time.Second)
+		for done := false; !done; {
+			select {
+			case msg, ok := <-mv.rx:
+				if !ok {
+					mv.fatal("device closed")
+				}
+				if msg.msgid != mavmsg_HEARTBEAT || msg.data[5] == mavap_INVALID || msg.data[4] == mavtype_GCS {
+					continue
+				}
+				mv.sysid = msg.sysid
+				mv.compid = msg.compid
+				mv.autopilot = msg.data[5]
+				mv.info = FCInfo{Variant: mav_autopilot(mv.autopilot), Board: mav_vehicle(msg.data[4]), Api: "MAVLink"}
+				mv.printf("%s %s, system %d, component %d\n", mv.info.Variant, mv.info.Board, mv.sysid, mv.compid)
+				return
+			case <-tm:
+				done = true
+			}
+		}
+	}
+	mv.fatal("no heartbeat")
+}
+
+func (mv *MAVLink) target(b []byte) []byte {
+	return append(b, mv.sysid, mv.compid)
+}
+
+func (mv *MAVLink) send_item(it MavItem) {
+	mv.send(mavmsg_MISSION_ITEM_INT, serialise_mav_item(it, mv.sysid, mv.compid))
+}
+
+func serialise_mav_item(it MavItem, sysid byte, compid byte) []byte {
+	b := make([]byte, 38)
+	for j, p := range it.params {
+		binary.LittleEndian.PutUint32(b[4*j:], math.Float32bits(p))
+	}
+	binary.LittleEndian.PutUint32(b[16:], uint32(int32(it.lat*1e7)))
+	binary.LittleEndian.PutUint32(b[20:], uint32(int32(it.lon*1e7)))
+	binary.LittleEndian.PutUint32(b[24:], math.Float32bits(it.alt))
+	binary.LittleEndian.PutUint16(b[28:], uint16(it.seq))
+	binary.LittleEndian.PutUint16(b[30:], it.command)
+	b[32] = sysid
+	b[33] = compid
+	b[34] = it.frame
+	b[36] = 1 // autocontinue
+	return b
+}
+
+func deserialise_mav_item(b []byte) MavItem {
+	var it MavItem
+	for j := range it.params {
+		it.params[j] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*j:]))
+	}
+	it.lat = float64(int32(binary.LittleEndian.Uint32(b[16:]))) / 1e7
+	it.lon = float64(int32(binary.LittleEndian.Uint32(b[20:]))) / 1e7
+	it.alt = math.Float32frombits(binary.LittleEndian.Uint32(b[24:]))
+	it.seq = int(binary.LittleEndian.Uint16(b[28:]))
+	it.command = binary.LittleEndian.Uint16(b[30:])
+	it.frame = b[34]
+	return it
+}
+
+func (mv *MAVLink) wait_ack() error {
+	msg, ok := mv.wait(mav_TIMEOUT*2, mavmsg_MISSION_ACK)
+	if !ok {
+		mv.fatal("no mission acknowledgement")
+	}
+	if msg.data[2] != 0 {
+		return fmt.Errorf("mission rejected (%s)", mav_result(msg.data[2]))
+	}
+	return nil
+}
+
+// Uploads the items; the vehicle requests each item in turn and
+// acknowledges the complete mission
+func (mv *MAVLink) upload(items []MavItem) error {
+	count := func() {
+		b := make([]byte, 2, 4)
+		binary.LittleEndian.PutUint16(b, uint16(len(items)))
+		mv.send(mavmsg_MISSION_COUNT, mv.target(b))
+	}
+	count()
+	next := 0
+	for retries := 0; ; {
+		msg, ok := mv.wait(mav_TIMEOUT, mavmsg_MISSION_REQUEST_INT, mavmsg_MISSION_REQUEST, mavmsg_MISSION_ACK)
+		if !ok {
+			if retries++; retries > mav_RETRIES {
+				mv.fatal(fmt.Sprintf("upload timeout (item %d of %d)", next, len(items)))
+			}
+			if next == 0 {
+				count()
+			}
+			continue
+		}
+		retries = 0
+		switch msg.msgid {
+		case mavmsg_MISSION_REQUEST_INT, mavmsg_MISSION_REQUEST:
+			seq := int(binary.LittleEndian.Uint16(msg.data))
+			if seq >= len(items) {
+				return fmt.Errorf("vehicle requested item %d of %d", seq, len(items))
+			}
+			mv.send_item(items[seq])
+			mv.printf("Upload %d\r", seq+1)
+			next = seq + 1
+		case mavmsg_MISSION_ACK:
+			if msg.data[2] != 0 {
+				return fmt.Errorf("mission rejected (%s)", mav_result(msg.data[2]))
+			}
+			if next < len(items) {
+				return fmt.Errorf("mission accepted after %d of %d items", next, len(items))
+			}
+			mv.printf("upload %d items\n", len(items))
+			mv.info.WpCount = len(items)
+			mv.info.WpValid = 1
+			return nil
+		}
+	}
+}
+
+func (mv *MAVLink) download() []MavItem {
+	var msg MavMsg
+	var ok bool
+	for j := 0; !ok; j++ {
+		if j == mav_RETRIES {
+			mv.fatal("no mission count")
+		}
+		mv.send(mavmsg_MISSION_REQUEST_LIST, mv.target(nil))
+		msg, ok = mv.wait(mav_TIMEOUT, mavmsg_MISSION_COUNT)
+	}
+	n := int(binary.LittleEndian.Uint16(msg.data))
+	items := []MavItem{}
+	for seq, retries := 0, 0; seq < n; {
+		b := make([]byte, 2, 4)
+		binary.LittleEndian.PutUint16(b, uint16(seq))
+		mv.send(mavmsg_MISSION_REQUEST_INT, mv.target(b))
+		msg, ok = mv.wait(mav_TIMEOUT, mavmsg_MISSION_ITEM_INT)
+		if ok {
+			if it := deserialise_mav_item(msg.data); it.seq == seq {
+				items = append(items, it)
+				seq++
+				retries = 0
+				continue
+			}
+		}
+		if retries++; retries > mav_RETRIES {
+			mv.fatal(fmt.Sprintf("download timeout (item %d of %d)", seq, n))
+		}
+	}
+	mv.send(mavmsg_MISSION_ACK, mv.target([]byte{}))
+	mv.info.WpCount = n
+	return items
+}
+
+func (mv *MAVLink) clear() error {
+	mv.send(mavmsg_MISSION_CLEAR_ALL, mv.target(nil))
+	return mv.wait_ack()
+}
+
+// INAV speeds (cm/s) are set by DO_CHANGE_SPEED
+func wp_speed(mi MissionItem) int16 {
+	switch mi.Action {
+	case "WAYPOINT", "LAND":
+		return mi.P1
+	case "POSHOLD_TIME":
+		return mi.P2
+	}
+	return 0
+}
+
+// Maps an INAV mission segment to MAVLink items (the inverse of
+// process_qgc), returning notes on anything approximated or dropped.
+// ArduPilot reserves item 0 for the home location.
+func mission_to_mav(ms MissionSegment, ardupilot bool) ([]MavItem, []string) {
+	items := []MavItem{}
+	notes := []string{}
+	if ardupilot {
+		hlat, hlon := ms.Metadata.Homey, ms.Metadata.Homex
+		if hlat == 0 && hlon == 0 && len(ms.MissionItems) > 0 {
+			hlat, hlon = ms.MissionItems[0].Lat, ms.MissionItems[0].Lon
+		}
+		items = append(items, MavItem{command: mavcmd_NAV_WAYPOINT, frame: mavframe_GLOBAL, lat: hlat, lon: hlon})
+	}
+	// MAVLink sequence of each WP, for JUMP targets
+	wpseq := make([]int, len(ms.MissionItems))
+	jumps := []int{}
+	speed := int16(0)
+	for j, mi := range ms.MissionItems {
+		if spd := wp_speed(mi); spd > 0 && spd != speed {
+			items = append(items, MavItem{command: mavcmd_DO_CHANGE_SPEED, frame: mavframe_MISSION,
+				params: [4]float32{1, float32(spd) / 100, -1, 0}})
+			speed = spd
+		} else if spd == 0 && speed != 0 && mi.is_GeoPoint() && mi.Action != "SET_POI" {
+			notes = append(notes, fmt.Sprintf("WP %d: default speed, flown at the previous speed", j+1))
+		}
+		it := MavItem{frame: mavframe_GLOBAL_RELATIVE_ALT_INT, lat: mi.Lat, lon: mi.Lon, alt: float32(mi.Alt)}
+		if mi.P3&1 != 0 {
+			it.frame = mavframe_GLOBAL_INT
+		}
+		if mi.P3&^1 != 0 {
+			notes = append(notes, fmt.Sprintf("WP %d: user actions (p3=%d) dropped", j+1, mi.P3))
+		}
+		switch mi.Action {
+		case "WAYPOINT":
+			it.command = mavcmd_NAV_WAYPOINT
+		case "POSHOLD_TIME":
+			it.command = mavcmd_NAV_LOITER_TIME
+			it.params[0] = float32(mi.P1)
+		case "POSHOLD_UNLIM":
+			it.command = mavcmd_NAV_LOITER_UNLIM
+		case "LAND":
+			it.command = mavcmd_NAV_LAND
+		case "SET_POI":
+			it.command = mavcmd_DO_SET_ROI_LOCATION
+		case "RTH":
+			it = MavItem{command: mavcmd_NAV_RETURN_TO_LAUNCH, frame: mavframe_MISSION}
+			if mi.P1 != 0 {
+				notes = append(notes, fmt.Sprintf("WP %d: RTH land is left to the autopilot's RTL behaviour", j+1))
+			}
+		case "JUMP":
+			it = MavItem{command: mavcmd_DO_JUMP, frame: mavframe_MISSION, params: [4]float32{0, float32(mi.P2), 0, 0}}
+			jumps = append(jumps, j)
+		case "SET_HEAD":
+			if mi.P1 == -1 {
+				it = MavItem{command: mavcmd_DO_SET_ROI_NONE, frame: mavframe_MISSION}
+			} else {
+				it = MavItem{command: mavcmd_CONDITION_YAW, frame: mavframe_MISSION, params: [4]float32{float32(mi.P1), 0, 1, 0}}
+			}
+		default:
+			notes = append(notes, fmt.Sprintf("WP %d: %s dropped", j+1, mi.Action))
+			wpseq[j] = len(items)
+			continue
+		}
+		wpseq[j] = len(items)
+		items = append(items, it)
+	}
+	for _, j := range jumps {
+		if tgt := int(ms.MissionItems[j].P1) - 1; tgt >= 0 && tgt < len(wpseq) {
+			items[wpseq[j]].params[0] = float32(wpseq[tgt])
+		}
+	}
+	if has_fwapproach(ms.FWApproach) {
+		notes = append(notes, "FW approach dropped")
+	}
+	for j := range items {
+		items[j].seq = j
+	}
+	return items, notes
+}
+
+// Maps MAVLink items to an INAV mission (the inverse of mission_to_mav),
+// returning notes on anything approximated or dropped
+func mission_from_mav(items []MavItem, ardupilot bool) (*MultiMission, []string) {
+	mis := []MissionItem{}
+	notes := []string{}
+	var hlat, hlon float64
+	if ardupilot && len(items) > 0 {
+		hlat, hlon = items[0].lat, items[0].lon
+		items = items[1:]
+	}
+	// WP number for each item sequence, for JUMP targets
+	seqwp := map[int]int{}
+	speed := int16(0)
+	var last MissionItem
+	for k, it := range items {
+		seqwp[it.seq] = len(mis) + 1
+		mi := MissionItem{Lat: it.lat, Lon: it.lon, Alt: int32(it.alt)}
+		switch it.frame {
+		case mavframe_GLOBAL, mavframe_GLOBAL_INT:
+			mi.P3 = 1
+		case mavframe_GLOBAL_TERRAIN_ALT, mavframe_GLOBAL_TERRAIN_ALT_INT:
+			notes = append(notes, fmt.Sprintf("item %d: terrain altitude taken as relative", it.seq))
+		}
+		switch it.command {
+		case mavcmd_NAV_WAYPOINT:
+			mi.Action = "WAYPOINT"
+			mi.P1 = speed
+			if it.params[0] > 0 {
+				mi.Action = "POSHOLD_TIME"
+				mi.P1 = int16(it.params[0])
+				mi.P2 = speed
+			}
+		case mavcmd_NAV_LOITER_TIME:
+			mi.Action = "POSHOLD_TIME"
+			mi.P1 = int16(it.params[0])
+			mi.P2 = speed
+		case mavcmd_NAV_LOITER_UNLIM:
+			mi.Action = "POSHOLD_UNLIM"
+		case mavcmd_NAV_LAND:
+			mi.Action = "LAND"
+			mi.P1 = speed
+			if mi.Lat == 0 && mi.Lon == 0 {
+				mi.Lat, mi.Lon = last.Lat, last.Lon
+			}
+		case mavcmd_DO_SET_ROI_LOCATION, mavcmd_DO_SET_ROI:
+			mi.Action = "SET_POI"
+		case mavcmd_NAV_RETURN_TO_LAUNCH:
+			mi = MissionItem{Action: "RTH"}
+		case mavcmd_DO_JUMP:
+			mi = MissionItem{Action: "JUMP", P1: int16(it.params[0]), P2: int16(it.params[1])}
+		case mavcmd_CONDITION_YAW:
+			mi = MissionItem{Action: "SET_HEAD", P1: int16(it.params[0])}
+		case mavcmd_DO_SET_ROI_NONE:
+			mi = MissionItem{Action: "SET_HEAD", P1: -1}
+		case mavcmd_DO_CHANGE_SPEED:
+			if it.params[1] > 0 {
+				speed = int16(it.params[1] * 100)
+			}
+			continue
+		default:
+			notes = append(notes, fmt.Sprintf("item %d: MAV_CMD %d dropped", it.seq, it.command))
+			continue
+		}
+		if mi.is_GeoPoint() {
+			last = mi
+		}
+		mis = append(mis, mi)
+		if mi.Action == "RTH" {
+			if k < len(items)-1 {
+				notes = append(notes, "items after RTL dropped")
+			}
+			break
+		}
+	}
+	for j := range mis {
+		if mis[j].Action == "JUMP" {
+			if n, ok := seqwp[int(mis[j].P1)]; ok {
+				mis[j].P1 = int16(n)
+			} else {
+				notes = append(notes, fmt.Sprintf("WP %d: invalid JUMP target %d", j+1, mis[j].P1))
+				mis[j].P1 = 0
+			}
+		}
+	}
+	mm := NewMultiMission(mis)
+	mm.Segment[0].Metadata.Homey = hlat
+	mm.Segment[0].Metadata.Homex = hlon
+	return mm, notes
+}
+
+// As run_device, for a MAVLink autopilot
+func (r *Result) run_mavlink(devdesc DevDescription, msgs io.Writer, fn func(mv *MAVLink) bool) {
+	defer r.recover_fc()
+	var mv *MAVLink
+	var err error
+	r.timed("connect", func() {
+		if mv, err = NewMAVLink(devdesc); err == nil {
+			mv.msgs = msgs
+			mv.Init()
+		}
+	})
+	if err != nil {
+		r.fail(EXIT_FC, "%v", err)
+		return
+	}
+	r.FC = &mv.info
+	if !fn(mv) && r.status == EXIT_OK {
+		r.status = EXIT_FAIL
+	}
+}
+
+func (mv *MAVLink) download_mission() *MultiMission {
+	m, notes := mission_from_mav(mv.download(), mv.autopilot == mavap_ARDUPILOT)
+	for _, n := range notes {
+		mv.printf("  %s\n", n)
+	}
+	return m
+}
+
+// Uploads (and optionally verifies) a single segment mission over MAVLink
+func (r *Result) upload_mavlink(mv *MAVLink, m *MultiMission, mtype string, eeprom bool, verify bool) bool {
+	sanitise_mission(m, mtype)
+	if fc_rebase() {
+		r.fail(EXIT_USAGE, "-rebase fc is not supported over MAVLink")
+		return false
+	}
+	m.Update_mission_meta(given_rebase())
+	r.set_mission(m)
+	if len(m.Segment) != 1 {
+		r.fail(EXIT_FAIL, "MAVLink missions have one segment (use extract)")
+		return false
+	}
+	if !m.valid_for(math.MaxUint16) {
+		r.fail(EXIT_FAIL, "Mission fails verification: %s", strings.Join(m.validate(math.MaxUint16), "; "))
+		return false
+	}
+	if len(m.Settings) > 0 {
+		mv.printf("Note: INAV mission settings are ignored\n")
+	}
+	items, notes := mission_to_mav(m.Segment[0], mv.autopilot == mavap_ARDUPILOT)
+	for _, n := range notes {
+		mv.printf("  %s\n", n)
+	}
+	var err error
+	r.timed("upload", func() { err = mv.upload(items) })
+	if err != nil {
+		r.fail(EXIT_FAIL, "Mission upload failed: %v", err)
+		return false
+	}
+	// Autopilots keep missions in non-volatile storage
+	r.Saved = eeprom
+	if verify {
+		var d *MissionDiff
+		// As MAVLink represents the mission, e.g. with inherited speeds
+		want, _ := mission_from_mav(items, mv.autopilot == mavap_ARDUPILOT)
+		r.timed("verify", func() { d = Diff_missions(want, mv.download_mission(), false) })
+		ok := len(d.lines) == 0
+		r.Verified = &ok
+		r.Differences = d.lines
+		if !ok {
+			r.fail(EXIT_FAIL, "Verify failed:\n%s", strings.Join(d.lines, "\n"))
+			return false
+		}
+		mv.printf("Verified\n")
+	}
+	return true
+}
+
+func do_clear_mavlink(devdesc DevDescription) {
+	r := NewResult("clear", false)
+	r.run_mavlink(devdesc, nil, func(mv *MAVLink) bool {
+		if err := mv.clear(); err != nil {
+			r.fail(EXIT_FAIL, "Mission clear failed: %v", err)
+			return false
+		}
+		mv.printf("Mission cleared\n")
+		return true
+	})
+	r.exit()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// An in-process autopilot, answering the mission protocol as ArduPilot or
+// PX4 would
+type fake_autopilot struct {
+	r      *io.PipeReader // from the GCS
+	w      *io.PipeWriter // to the GCS
+	seq    byte
+	ap     byte      // MAV_AUTOPILOT
+	items  []MavItem // the vehicle's mission
+	count  int       // items expected by an upload
+	result byte      // MAV_MISSION_RESULT of a completed upload
+	silent bool      // only heartbeats are answered
+}
+
+// The GCS end of the link
+type pipe_link struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipe_link) Close() error {
+	p.PipeReader.Close()
+	return p.PipeWriter.Close()
+}
+
+// Sends as system 1, component 1
+func (f *fake_autopilot) send(msgid uint32, payload []byte) {
+	buf := encode_mavlink(f.seq, msgid, payload)
+	f.seq++
+	buf[5], buf[6] = 1, 1
+	n := len(buf) - 2
+	crc := uint16(0xffff)
+	for _, b := range buf[1:n] {
+		crc = crc_x25(crc, b)
+	}
+	crc = crc_x25(crc, mav_msgs[msgid].extra)
+	binary.LittleEndian.PutUint16(buf[n:], crc)
+	f.w.Write(buf)
+}
+
+func (f *fake_autopilot) request(seq int) {
+	b := []byte{0, 0, mav_SYSID, mav_COMPID}
+	binary.LittleEndian.PutUint16(b, uint16(seq))
+	f.send(mavmsg_MISSION_REQUEST_INT, b)
+}
+
+func (f *fake_autopilot) ack(result byte) {
+	f.send(mavmsg_MISSION_ACK, []byte{mav_SYSID, mav_COMPID, result, 0})
+}
+
+func (f *fake_autopilot) handle(msg *MavMsg) {
+	if msg.msgid == mavmsg_HEARTBEAT {
+		f.send(mavmsg_HEARTBEAT, []byte{0, 0, 0, 0, 1, f.ap, 0, 4, 3}) // fixed wing
+		return
+	}
+	if f.silent {
+		return
+	}
+	switch msg.msgid {
+	case mavmsg_MISSION_COUNT:
+		f.count = int(binary.LittleEndian.Uint16(msg.data))
+		f.items = []MavItem{}
+		f.request(0)
+	case mavmsg_MISSION_ITEM_INT:
+		if it := deserialise_mav_item(msg.data); it.seq == len(f.items) {
+			f.items = append(f.items, it)
+		}
+		if len(f.items) < f.count {
+			f.request(len(f.items))
+		} else {
+			f.ack(f.result)
+		}
+	case mavmsg_MISSION_REQUEST_LIST:
+		b := []byte{0, 0, mav_SYSID, mav_COMPID}
+		binary.LittleEndian.PutUint16(b, uint16(len(f.items)))
+		f.send(mavmsg_MISSION_COUNT, b)
+	case mavmsg_MISSION_REQUEST_INT:
+		if seq := int(binary.LittleEndian.Uint16(msg.data)); seq < len(f.items) {
+			f.send(mavmsg_MISSION_ITEM_INT, serialise_mav_item(f.items[seq], mav_SYSID, mav_COMPID))
+		}
+	case mavmsg_MISSION_CLEAR_ALL:
+		f.items = []MavItem{}
+		f.ack(0)
+	}
+}
+
+func (f *fake_autopilot) run() {
+	inp := make([]byte, 512)
+	buf := []byte{}
+	for {
+		n, err := f.r.Read(inp)
+		if err != nil {
+			return
+		}
+		buf = append(buf, inp[:n]...)
+		for {
+			msg, used := decode_mavlink(buf)
+			if used == 0 {
+				break
+			}
+			buf = buf[used:]
+			if msg != nil {
+				f.handle(msg)
+			}
+		}
+	}
+}
+
+// A MAVLink session with a fake autopilot, which may be set up (items,
+// result, silent) before the first request
+func mav_stand_in(t *testing.T, ap byte, setup func(f *fake_autopilot)) *MAVLink {
+	gr, fw := io.Pipe()
+	fr, gw := io.Pipe()
+	f := &fake_autopilot{r: fr, w: fw, ap: ap}
+	if setup != nil {
+		setup(f)
+	}
+	go f.run()
+	mv := &MAVLink{sd: pipe_link{gr, gw}, rx: make(chan MavMsg, 16), msgs: io.Discard}
+	mv.Init()
+	t.Cleanup(func() {
+		mv.sd.Close()
+		fr.Close()
+		fw.Close()
+	})
+	if mv.sysid != 1 || mv.autopilot != ap {
+		t.Fatalf("heartbeat: system %d, autopilot %d", mv.sysid, mv.autopilot)
+	}
+	return mv
+}
+
+func sample_items(t *testing.T, ardupilot bool) []MavItem {
+	items, _ := mission_to_mav(sample_mission(t).Segment[0], ardupilot)
+	cmds := map[uint16]int{}
+	for _, it := range items {
+		cmds[it.command]++
+	}
+	if cmds[mavcmd_DO_JUMP] != 2 || cmds[mavcmd_DO_CHANGE_SPEED] == 0 {
+		t.Fatalf("sample items: %d DO_JUMP, %d DO_CHANGE_SPEED", cmds[mavcmd_DO_JUMP], cmds[mavcmd_DO_CHANGE_SPEED])
+	}
+	return items
+}
+
+func same_items(t *testing.T, want, got []MavItem) {
+	t.Helper()
+	if len(want) != len(got) {
+		t.Fatalf("%d items, want %d", len(got), len(want))
+	}
+	for j := range want {
+		a, b := want[j], got[j]
+		if a.seq != b.seq || a.command != b.command || a.frame != b.frame || a.params != b.params || a.alt != b.alt ||
+			int32(a.lat*1e7) != int32(b.lat*1e7) || int32(a.lon*1e7) != int32(b.lon*1e7) {
+			t.Errorf("item %d: %+v, want %+v", j, b, a)
+		}
+	}
+}
+
+func TestMavUpload(t *testing.T) {
+	var f *fake_autopilot
+	mv := mav_stand_in(t, mavap_ARDUPILOT, func(fa *fake_autopilot) { f = fa })
+	items := sample_items(t, true)
+	if err := mv.upload(items); err != nil {
+		t.Fatal(err)
+	}
+	same_items(t, items, f.items)
+	if mv.info.WpCount != len(items) {
+		t.Errorf("WpCount %d, want %d", mv.info.WpCount, len(items))
+	}
+}
+
+func TestMavUploadRejected(t *testing.T) {
+	mv := mav_stand_in(t, mavap_PX4, func(f *fake_autopilot) { f.result = 5 })
+	err := mv.upload(sample_items(t, false))
+	if err == nil || !strings.Contains(err.Error(), "mission rejected (invalid)") {
+		t.Fatalf("upload: %v, want rejected", err)
+	}
+}
+
+func TestMavDownload(t *testing.T) {
+	items := sample_items(t, false)
+	mv := mav_stand_in(t, mavap_PX4, func(f *fake_autopilot) { f.items = items })
+	same_items(t, items, mv.download())
+}
+
+func TestMavClear(t *testing.T) {
+	var f *fake_autopilot
+	mv := mav_stand_in(t, mavap_ARDUPILOT, func(fa *fake_autopilot) {
+		f = fa
+		f.items = sample_items(t, true)
+	})
+	if err := mv.clear(); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.items) != 0 {
+		t.Errorf("%d items after clear", len(f.items))
+	}
+}
+
+func TestMavTimeout(t *testing.T) {
+	mv := mav_stand_in(t, mavap_ARDUPILOT, func(f *fake_autopilot) { f.silent = true })
+	defer func() {
+		e, ok := recover().(MSPError)
+		if !ok || !strings.Contains(string(e), "no mission acknowledgement") {
+			t.Errorf("clear: %v, want no acknowledgement", e)
+		}
+	}()
+	mv.clear()
+}
+
+// mission_to_mav -> upload -> download -> mission_from_mav is the mission
+func TestMavRoundTrip(t *testing.T) {
+	for _, ap := range []byte{mavap_ARDUPILOT, mavap_PX4} {
+		mm := sample_mission(t)
+		items, notes := mission_to_mav(mm.Segment[0], ap == mavap_ARDUPILOT)
+		if len(notes) != 0 {
+			t.Errorf("%s: notes %v", mav_autopilot(ap), notes)
+		}
+		mv := mav_stand_in(t, ap, nil)
+		if err := mv.upload(items); err != nil {
+			t.Fatal(err)
+		}
+		back, notes := mission_from_mav(mv.download(), ap == mavap_ARDUPILOT)
+		if len(notes) != 0 {
+			t.Errorf("%s: notes %v", mav_autopilot(ap), notes)
+		}
+		if d := Diff_missions(mm, back, false); len(d.lines) != 0 {
+			t.Errorf("%s: round trip differs:\n%s", mav_autopilot(ap), strings.Join(d.lines, "\n"))
+		}
+	}
+}
+
+// A WP at the default speed inherits the previous speed, and RTH land is
+// dropped; -verify compares the mission as MAVLink represents it
+func TestMavVerify(t *testing.T) {
+	mm := read_inav_cli([]byte(`wp 0 1 545430472 -19263818 1600 500 0 0 0
+wp 1 1 545429651 -19260549 1600 0 0 0 0
+wp 2 4 0 0 0 1 0 0 165
+`))
+	mv := mav_stand_in(t, mavap_ARDUPILOT, nil)
+	r := NewResult("upload", false)
+	if !r.upload_mavlink(mv, mm, "inav cli", false, true) {
+		t.Fatalf("upload -verify: %s", r.Error)
+	}
+	if r.Verified == nil || !*r.Verified {
+		t.Errorf("not verified: %v", r.Differences)
+	}
+}
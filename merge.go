@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func outfmt_extension(ofmt string) string {
+	switch ofmt {
+	case "json":
+		return ".json"
+	case "cli":
+		return ".txt"
+	case "md":
+		return ".md"
+	case "svg", "png":
+		return "." + ofmt
+	default:
+		return ".mission"
+	}
+}
+
+// Each segment of each input mission becomes a segment of the result
+func Merge_missions(mms []*MultiMission) *MultiMission {
+	mis := []MissionItem{}
+	segs := []MissionSegment{}
+	svs := []SettingValue{}
+	shs := []Safehome{}
+	gzs := []Geozone{}
+	for _, m := range mms {
+		for _, ms := range m.Segment {
+			nmi := len(ms.MissionItems)
+			if nmi == 0 {
+				continue
+			}
+			for k, mi := range ms.MissionItems {
+				if k == nmi-1 {
+					mi.Flag = 0xa5
+				} else if mi.Flag == 0xa5 {
+					mi.Flag = 0
+				}
+				mis = append(mis, mi)
+			}
+			segs = append(segs, ms)
+		}
+		svs = merge_settings(svs, m.Settings)
+		shs = append(shs, m.Safehomes...)
+		gzs = append(gzs, m.Geozones...)
+	}
+	mm := NewMultiMission(mis)
+	for j := range mm.Segment {
+		if j < len(segs) {
+			mm.Segment[j].Metadata = segs[j].Metadata
+			mm.Segment[j].FWApproach = segs[j].FWApproach
+			if mm.Segment[j].FWApproach.No > 7 {
+				mm.Segment[j].FWApproach.Index = int8(j)
+				mm.Segment[j].FWApproach.No = int8(j + 8)
+			}
+		}
+	}
+	if len(svs) > 0 {
+		mm.Settings = svs
+	}
+	// Safehomes and geozones are shared by all segments
+	for j := range shs {
+		shs[j].No = j
+	}
+	for j := range gzs {
+		gzs[j].No = j
+	}
+	if len(shs) > 0 {
+		mm.Safehomes = shs
+	}
+	if len(gzs) > 0 {
+		mm.Geozones = gzs
+	}
+	return mm
+}
+
+// Returns segment n (1 based) as a single segment mission
+func (mm *MultiMission) Extract_segment(n int) (*MultiMission, error) {
+	if n < 1 || n > len(mm.Segment) {
+		return nil, fmt.Errorf("invalid segment %d (of %d)", n, len(mm.Segment))
+	}
+	ms := mm.Segment[n-1]
+	ms.MissionItems = append([]MissionItem{}, ms.MissionItems...)
+	if ms.FWApproach.No > 7 {
+		ms.FWApproach.Index = 0
+		ms.FWApproach.No = 8
+	}
+	m := &MultiMission{Version: Version{Value: GetVersion()}, Segment: []MissionSegment{ms}, Settings: mm.Settings,
+		Safehomes: mm.Safehomes, Geozones: mm.Geozones}
+	m.Renumber_segments()
+	return m, nil
+}
+
+// merge A B C ... -o out
+func do_merge(files []string, outf string) {
+	mms := []*MultiMission{}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, path.Base(f))
+		mtype, m, err := Read_Mission_File(f)
+		if m == nil || err != nil {
+			log.Printf("Invalid input file %s\n", f)
+			os.Exit(EXIT_USAGE)
+		}
+		sanitise_mission(m, mtype)
+		mms = append(mms, m)
+	}
+	mm := Merge_missions(mms)
+	if err := mm.check_segments(DEFAULT_MAX_WP); err != nil {
+		log.Fatalf("merge: %v\n", err)
+	}
+	fmt.Fprintf(os.Stderr, "Merged %d segments, %d WP\n", len(mm.Segment), mm.wp_count())
+	mm.Dump(*outfmt, outf, strings.Join(names, ", "), "merge")
+}
+
+// split FILE DIR
+func do_split(args []string) {
+	_, mm, err := Read_Mission_File(args[0])
+	if mm == nil || err != nil {
+		log.Println("Invalid input file")
+		os.Exit(EXIT_USAGE)
+	}
+	if err = os.MkdirAll(args[1], 0755); err != nil {
+		log.Fatal(err)
+	}
+	base := path.Base(args[0])
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	for j := range mm.Segment {
+		m, _ := mm.Extract_segment(j + 1)
+		outf := filepath.Join(args[1], fmt.Sprintf("%s-seg%d%s", base, j+1, outfmt_extension(*outfmt)))
+		m.Dump(*outfmt, outf, args[0], fmt.Sprintf("segment %d", j+1))
+		fmt.Fprintf(os.Stderr, "Segment %d: %d WP -> %s\n", j+1, len(m.Segment[0].MissionItems), outf)
+	}
+}
+
+// extract -seg n FILE [OUTFILE]
+func do_extract(n int, files []string) {
+	inf, outf := verify_in_out_files(files)
+	_, mm, err := Read_Mission_File(inf)
+	if mm == nil || err != nil {
+		log.Println("Invalid input file")
+		os.Exit(EXIT_USAGE)
+	}
+	m, err := mm.Extract_segment(n)
+	if err != nil {
+		log.Printf("extract: %v\n", err)
+		os.Exit(EXIT_USAGE)
+	}
+	m.Dump(*outfmt, outf, inf, fmt.Sprintf("segment %d", n))
+}
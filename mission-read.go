@@ -17,6 +17,16 @@ func Read_Mission_File(path string) (string, *MultiMission, error) {
 		return "?", nil, err
 	} else {
 		mtype, m := handle_mission_data(dat, path)
+		if m != nil && path != "" && path != "-" {
+			sidecar := settings_sidecar_name(path)
+			if _, serr := os.Stat(sidecar); serr == nil {
+				svs, serr := read_settings_sidecar(sidecar)
+				if serr != nil {
+					return mtype, nil, serr
+				}
+				m.Settings = merge_settings(m.Settings, svs)
+			}
+		}
 		if m == nil || !m.is_valid() {
 			fmt.Fprintf(os.Stderr, "Note: Mission fails verification %s\n", mtype)
 		}
@@ -9,8 +9,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"math"
+	"math/bits"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -23,32 +25,29 @@ type QGCrec struct {
 	lon     float64
 	alt     float64
 	params  [4]float64
+	fwa     *FWApproach // FW landing pattern
 }
 
 type qgc_plan struct {
 	Filetype string `json:"fileType"`
 	Mission  struct {
-		Items []struct {
-			Typ          string    `json:"type"`
-			Altitude     int       `json:"Altitude"`
-			Altitudemode int       `json:"AltitudeMode"`
-			Command      int       `json:"command"`
-			Jumpid       int       `json:"doJumpId"`
-			Frame        int       `json:"frame"`
-			Params       []float64 `json:"params"`
-			Transect     struct {
-				Items []struct {
-					Typ         string    `json:"type"`
-					Altitude    int       `json:"Altitude"`
-					Alitudemode int       `json:"AltitudeMode"`
-					Command     int       `json:"command"`
-					Jumpid      int       `json:"doJumpId"`
-					Frame       int       `json:"frame"`
-					Params      []float64 `json:"params"`
-				} `json:"items"`
-			} `json:"TransectStyleComplexItem,omitempty"`
-		} `json:"items"`
+		Items       []qgc_complex `json:"items"`
+		PlannedHome []float64     `json:"plannedHomePosition"`
+		CruiseSpeed float64       `json:"cruiseSpeed"`
+		HoverSpeed  float64       `json:"hoverSpeed"`
+		VehicleType int           `json:"vehicleType"`
 	} `json:"mission"`
+	GeoFence    qgc_fence `json:"geoFence"`
+	RallyPoints qgc_rally `json:"rallyPoints"`
+}
+
+// Default WP speed (cm/s), cruise for fixed wing (MAV_TYPE 1), otherwise hover
+func (qm *qgc_plan) default_speed() int16 {
+	spd := qm.Mission.HoverSpeed
+	if qm.Mission.VehicleType == 1 {
+		spd = qm.Mission.CruiseSpeed
+	}
+	return int16(spd * 100)
 }
 
 type PlaceMark struct {
@@ -110,10 +109,13 @@ type MissionSegment struct {
 }
 
 type MultiMission struct {
-	XMLName xml.Name         `xml:"mission"  json:"-"`
-	Version Version          `xml:"version" json:"-"`
-	Comment string           `xml:",comment" json:"-"`
-	Segment []MissionSegment `json:"missions"`
+	XMLName   xml.Name         `xml:"mission"  json:"-"`
+	Version   Version          `xml:"version" json:"-"`
+	Comment   string           `xml:",comment" json:"-"`
+	Segment   []MissionSegment `json:"missions"`
+	Settings  []SettingValue   `xml:"settings>setting,omitempty" json:"settings,omitempty"`
+	Safehomes []Safehome       `xml:"safehomes>safehome,omitempty" json:"safehomes,omitempty"`
+	Geozones  []Geozone        `xml:"geozones>geozone,omitempty" json:"geozones,omitempty"`
 }
 
 type Mission struct {
@@ -137,7 +139,7 @@ func (ml *MissionSegment) MarshalXML(e *xml.Encoder, start xml.StartElement) err
 		}
 	}
 
-	if ml.FWApproach.No > 7 && ml.FWApproach.Dirn1 != 0 && ml.FWApproach.Dirn2 != 0 {
+	if has_fwapproach(ml.FWApproach) {
 		err := e.EncodeElement(ml.FWApproach, xml.StartElement{Name: xml.Name{Local: "fwapproach"}})
 		return err
 	}
@@ -235,6 +237,7 @@ type Pts struct {
 	Lat  float64 `xml:"lat,attr"`
 	Lon  float64 `xml:"lon,attr"`
 	Elev float64 `xml:"ele"`
+	Time string  `xml:"time"`
 }
 
 func read_gpx(dat []byte) *MultiMission {
@@ -249,6 +252,14 @@ func read_gpx(dat []byte) *MultiMission {
 			pts = g.Rpts
 		} else if len(g.Tpts) > 0 {
 			pts = g.Tpts
+			// A timed track may be a recorded flight
+			if *gpxtrack && pts[0].Time != "" {
+				tps := make([]TrackPoint, len(pts))
+				for k, p := range pts {
+					tps[k] = TrackPoint{p.Lat, p.Lon, p.Elev}
+				}
+				return track_mission("GPX", tps, false)
+			}
 		}
 		if pts != nil {
 			for k, p := range pts {
@@ -268,32 +279,50 @@ func (mi *MissionItem) is_GeoPoint() bool {
 	return !(a == "RTH" || a == "SET_HEAD" || a == "JUMP")
 }
 
+// WP limit assumed when the FC's own limit is not known
+const DEFAULT_MAX_WP = 120
+
 func (mm *MultiMission) is_valid() bool {
-	force := os.Getenv("IMPLOAD_NO_VERIFY")
-	if len(force) > 0 {
+	return mm.valid_for(DEFAULT_MAX_WP)
+}
+
+// Validity for an FC supporting maxwp waypoints
+func (mm *MultiMission) valid_for(maxwp int) bool {
+	if no_verify() {
 		return true
 	}
+	return len(mm.validate(maxwp)) == 0
+}
+
+// Returns the reasons (if any) the mission fails the inav mission rules
+func (mm *MultiMission) Validate() []string {
+	return mm.validate(DEFAULT_MAX_WP)
+}
+
+func (mm *MultiMission) validate(maxwp int) []string {
+	problems := []string{}
 	// Urg, Urg array index v. WP Nos ......
 	xmlen := int16(0)
-	for _, m := range mm.Segment {
+	for j, m := range mm.Segment {
 		mlen := int16(len(m.MissionItems))
 		xmlen += mlen
 		for i := int16(0); i < mlen; i++ {
 			var target = m.MissionItems[i].P1 - 1
 			if m.MissionItems[i].Action == "JUMP" {
-				if (i == 0) || ((target > (i - 2)) && (target < (i + 2))) || (target >= mlen) || (m.MissionItems[i].P2 < -1) {
-					return false
+				if (i == 0) || (target < 0) || ((target > (i - 2)) && (target < (i + 2))) || (target >= mlen) || (m.MissionItems[i].P2 < -1) {
+					problems = append(problems, fmt.Sprintf("segment %d, WP %d: invalid JUMP", j+1, i+1))
+					continue
 				}
 				if !(m.MissionItems[target].Action == "WAYPOINT" || m.MissionItems[target].Action == "POSHOLD_TIME" || m.MissionItems[target].Action == "LAND") {
-					return false
+					problems = append(problems, fmt.Sprintf("segment %d, WP %d: JUMP target %d is not geographic", j+1, i+1, target+1))
 				}
 			}
 		}
 	}
-	if xmlen > int16(MaxWP) {
-		return false
+	if int(xmlen) > maxwp {
+		problems = append(problems, fmt.Sprintf("too many WPs (%d, max %d)", xmlen, maxwp))
 	}
-	return true
+	return append(problems, mm.profile_problems()...)
 }
 
 func (m *MissionSegment) Add_rtl(land bool) {
@@ -312,15 +341,32 @@ func (m *MissionSegment) Add_rtl(land bool) {
 }
 
 func (m *MultiMission) Dump(outfmt string, params ...string) {
+	w, err := openStdoutOrFile(params[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if w != os.Stdout { // stdout stays open for further output
+		defer w.Close()
+	}
+	m.Write(w, outfmt, params...)
+}
+
+// params are the output name, the input name and the input type (as Dump)
+func (m *MultiMission) Write(w io.Writer, outfmt string, params ...string) {
 	switch outfmt {
 	case "md":
-		m.To_md(params...)
+		m.To_md(w, params...)
 	case "cli":
-		m.To_cli(params[0])
+		m.To_cli(w)
 	case "json":
-		m.To_json(params[0])
+		m.To_json(w)
+	case "svg":
+		m.To_svg(w)
+	case "png":
+		m.To_png(w)
 	default:
-		m.To_xml(params...)
+		m.To_xml(w, params...)
 	}
 }
 
@@ -336,7 +382,8 @@ func read_simple(dat []byte) *MultiMission {
 			break
 		}
 		if err != nil {
-			log.Fatal(err)
+			fmt.Fprintf(os.Stderr, "CSV error: %v\n", err)
+			return nil
 		}
 
 		if record[0] == "no" {
@@ -422,40 +469,33 @@ func read_simple(dat []byte) *MultiMission {
 	return NewMultiMission(mis)
 }
 
-func read_qgc_json(dat []byte) []QGCrec {
+// The plan is returned for its home, speeds, fence and rally points
+func read_qgc_json(dat []byte) ([]QGCrec, *qgc_plan) {
 	qgcs := []QGCrec{}
 	var qm qgc_plan
 	json.Unmarshal(dat, &qm)
 	if qm.Filetype == "Plan" {
-		for _, qmi := range qm.Mission.Items {
+		for k := range qm.Mission.Items {
+			qmi := &qm.Mission.Items[k]
 			if qmi.Typ == "SimpleItem" {
-				if len(qmi.Params) == 7 {
-					qg := QGCrec{}
-					qg.jindex = qmi.Jumpid
-					qg.altmode = qmi.Altitudemode
-					qg.command = qmi.Command
-					qg.lat = qmi.Params[4]
-					qg.lon = qmi.Params[5]
-					qg.alt = qmi.Params[6]
-					for j := 0; j < 4; j++ {
-						qg.params[j] = qmi.Params[j]
-					}
+				if qg, ok := qgc_simple_rec(qmi.qgc_item, qmi.Altitudemode); ok {
 					qgcs = append(qgcs, qg)
 				}
 			} else if qmi.Typ == "ComplexItem" {
-				for _, qmii := range qmi.Transect.Items {
-					if len(qmii.Params) == 7 {
-						qg := QGCrec{}
-						qg.jindex = qmii.Jumpid
-						qg.altmode = qmi.Altitudemode
-						qg.command = qmii.Command
-						qg.lat = qmii.Params[4]
-						qg.lon = qmii.Params[5]
-						qg.alt = qmii.Params[6]
-						for j := 0; j < 4; j++ {
-							qg.params[j] = qmii.Params[j]
+				switch qmi.Complextype {
+				case "StructureScan":
+					qgcs = append(qgcs, qgc_structure_scan(qmi)...)
+				case "fwLandingPattern", "FixedWingLandingPattern":
+					qgcs = append(qgcs, qgc_fw_landing(qmi)...)
+				default:
+					// survey, CorridorScan and other transect styles
+					if len(qmi.Transect.Items) == 0 {
+						fmt.Fprintf(os.Stderr, "QGC: complex item %s dropped\n", qmi.Complextype)
+					}
+					for _, qmii := range qmi.Transect.Items {
+						if qg, ok := qgc_simple_rec(qmii, qmi.Altitudemode); ok {
+							qgcs = append(qgcs, qg)
 						}
-						qgcs = append(qgcs, qg)
 					}
 				}
 			}
@@ -463,11 +503,13 @@ func read_qgc_json(dat []byte) []QGCrec {
 	} else {
 		fmt.Fprintln(os.Stderr, "Skipping non-Plan file")
 	}
-	return qgcs
+	return qgcs, &qm
 }
 
-func read_qgc_text(dat []byte) []QGCrec {
+// The home location, if any, is item 0
+func read_qgc_text(dat []byte) ([]QGCrec, *QGCrec) {
 	qgcs := []QGCrec{}
+	var home *QGCrec
 
 	r := csv.NewReader(strings.NewReader(string(dat)))
 	r.Comma = '\t'
@@ -477,7 +519,7 @@ func read_qgc_text(dat []byte) []QGCrec {
 		for _, record := range records {
 			if len(record) == 12 {
 				no, err := strconv.Atoi(record[0])
-				if err == nil && no > 0 {
+				if err == nil && no >= 0 {
 					qg := QGCrec{}
 					qg.jindex = no
 					qg.command, _ = strconv.Atoi(record[3])
@@ -487,14 +529,18 @@ func read_qgc_text(dat []byte) []QGCrec {
 					for j := 0; j < 4; j++ {
 						qg.params[j], _ = strconv.ParseFloat(record[4+j], 64)
 					}
-					qgcs = append(qgcs, qg)
+					if no == 0 {
+						home = &qg
+					} else {
+						qgcs = append(qgcs, qg)
+					}
 				}
 			}
 		}
 	} else {
-		log.Fatal(err)
+		fmt.Fprintf(os.Stderr, "QGC error: %v\n", err)
 	}
-	return qgcs
+	return qgcs, home
 }
 
 func fixup_qgc_mission(mis []MissionItem, have_jump bool) ([]MissionItem, bool) {
@@ -505,16 +551,13 @@ func fixup_qgc_mission(mis []MissionItem, have_jump bool) ([]MissionItem, bool)
 				jumptgt := mis[i].P1
 				ajump := int16(0)
 				for j := range mis {
-					p3abs := mis[j].P3 // -ve indicate amsl
-					if p3abs < 0 {
-						p3abs *= -1
-					}
-					if p3abs == int16(jumptgt) {
+					if mis[j].P3 == int16(jumptgt) {
 						ajump = int16(j + 1)
 						break
 					}
 				}
 				if ajump == 0 {
+					fmt.Fprintf(os.Stderr, "QGC: WP %d: JUMP target %d not found\n", i+1, jumptgt)
 					ok = false
 				} else {
 					mis[i].P1 = ajump
@@ -522,6 +565,7 @@ func fixup_qgc_mission(mis []MissionItem, have_jump bool) ([]MissionItem, bool)
 				no := int16(i + 1) // item index
 				if mis[i].P1 < 1 || ((mis[i].P1 > no-2) &&
 					(mis[i].P1 < no+2)) {
+					fmt.Fprintf(os.Stderr, "QGC: WP %d: invalid JUMP to WP %d\n", i+1, mis[i].P1)
 					ok = false
 				}
 			}
@@ -529,11 +573,7 @@ func fixup_qgc_mission(mis []MissionItem, have_jump bool) ([]MissionItem, bool)
 	}
 	if ok {
 		for i := range mis {
-			if mis[i].P3 < 0 {
-				mis[i].P3 = 1
-			} else {
-				mis[i].P3 = 0
-			}
+			mis[i].P3 = 0
 		}
 		return mis, ok
 	} else {
@@ -541,13 +581,48 @@ func fixup_qgc_mission(mis []MissionItem, have_jump bool) ([]MissionItem, bool)
 	}
 }
 
+// Approximations for LOITER_TURNS, which inav flies as a timed hold
+const (
+	LOITER_RADIUS = 30.0 // m, if the item has none
+	LOITER_SPEED  = 5.0  // m/s, if no speed has been set
+)
+
+// User action (P3) bits for camera and servo commands; camera is USER1,
+// servos are allocated USER2 - USER4 in order of appearance
+const (
+	wp_USER1 = 1 << (iota + 1)
+	wp_USER2
+	wp_USER3
+	wp_USER4
+)
+
+// Position of the first geographic item from qs[j], for items without one
+func qgc_next_position(qs []QGCrec, j int) (float64, float64, bool) {
+	for ; j < len(qs); j++ {
+		switch qs[j].command {
+		case mavcmd_NAV_WAYPOINT, mavcmd_NAV_LOITER_UNLIM, mavcmd_NAV_LOITER_TURNS, mavcmd_NAV_LOITER_TIME, mavcmd_NAV_LAND:
+			if qs[j].lat != 0 || qs[j].lon != 0 {
+				return qs[j].lat, qs[j].lon, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
 func process_qgc(dat []byte, mtype string) *MultiMission {
 	var qs []QGCrec
+	var home *QGCrec
+	var qm *qgc_plan
 	var mis = []MissionItem{}
+	defspeed := int16(0)
 	if mtype == "qgc-text" {
-		qs = read_qgc_text(dat)
+		qs, home = read_qgc_text(dat)
 	} else {
-		qs = read_qgc_json(dat)
+		qs, qm = read_qgc_json(dat)
+		if ph := qm.Mission.PlannedHome; len(ph) >= 2 && (ph[0] != 0 || ph[1] != 0) {
+			home = &QGCrec{lat: ph[0], lon: ph[1]}
+		}
+		defspeed = qm.default_speed()
 	}
 	last_alt := 0.0
 	last_lat := 0.0
@@ -557,9 +632,9 @@ func process_qgc(dat []byte, mtype string) *MultiMission {
 	lastj := -1
 
 	for j, rq := range qs {
-		if rq.command == 20 {
+		if rq.command == mavcmd_NAV_RETURN_TO_LAUNCH {
 			lastj = j
-		} else if rq.command == 21 && j == lastj+1 {
+		} else if rq.command == mavcmd_NAV_LAND && j == lastj+1 {
 			have_land = true
 		}
 	}
@@ -567,35 +642,77 @@ func process_qgc(dat []byte, mtype string) *MultiMission {
 	last := false
 	have_jump := false
 
+	// Anything dropped or approximated is reported
+	note := func(q QGCrec, format string, a ...interface{}) {
+		fmt.Fprintf(os.Stderr, "QGC: item %d: %s\n", q.jindex, fmt.Sprintf(format, a...))
+	}
+	speed := defspeed
+	// user actions for the previous / next geographic WP
+	uacts := []int16{}
+	pending := int16(0)
+	servos := []int{}
+	// Jump targets of dropped items are the following WP
+	alias := map[int]int{}
+	dropped := []int{}
+	unknown := map[int][]string{}
+	var fwa *FWApproach
+
 	no := 0
-	for _, q := range qs {
+	for j, q := range qs {
 		ok := true
 		var action string
 		var p1, p2 int16
 
 		switch q.command {
-		case 16:
+		case mavcmd_NAV_WAYPOINT:
 			if q.params[0] == 0 {
 				action = "WAYPOINT"
-				p1 = 0
+				p1 = speed
 			} else {
 				action = "POSHOLD_TIME"
 				p1 = int16(q.params[0])
+				p2 = speed
 			}
 
-		case 19:
-			action = "POSHOLD_TIME"
-			p1 = int16(q.params[0])
-			if q.alt == 0 {
-				q.alt = last_alt
+		case mavcmd_NAV_TAKEOFF:
+			// inav has no take off; climb to the altitude, over the take off
+			// location, or home, or the first WP
+			action = "WAYPOINT"
+			p1 = speed
+			if q.lat == 0.0 && q.lon == 0.0 {
+				if last_lat != 0.0 || last_lon != 0.0 {
+					q.lat, q.lon = last_lat, last_lon
+				} else if home != nil {
+					q.lat, q.lon = home.lat, home.lon
+				} else {
+					q.lat, q.lon, _ = qgc_next_position(qs, j+1)
+				}
 			}
-			if q.lat == 0.0 {
-				q.lat = last_lat
+			note(q, "TAKEOFF approximated as a climb WP to %.0fm", q.alt)
+
+		case mavcmd_NAV_LOITER_UNLIM:
+			action = "POSHOLD_UNLIM"
+
+		case mavcmd_NAV_LOITER_TURNS:
+			action = "POSHOLD_TIME"
+			radius := math.Abs(q.params[2])
+			if radius == 0 {
+				radius = LOITER_RADIUS
 			}
-			if q.lon == 0.0 {
-				q.lon = last_lon
+			spd := LOITER_SPEED
+			if speed > 0 {
+				spd = float64(speed) / 100
 			}
-		case 20:
+			p1 = int16(math.Round(q.params[0] * 2 * math.Pi * radius / spd))
+			p2 = speed
+			note(q, "LOITER_TURNS (%.1f turns) approximated as a %ds hold", q.params[0], p1)
+
+		case mavcmd_NAV_LOITER_TIME:
+			action = "POSHOLD_TIME"
+			p1 = int16(q.params[0])
+			p2 = speed
+
+		case mavcmd_NAV_RETURN_TO_LAUNCH:
 			action = "RTH"
 			q.lat = 0.0
 			q.lon = 0.0
@@ -605,19 +722,17 @@ func process_qgc(dat []byte, mtype string) *MultiMission {
 			q.alt = 0
 			last = true
 
-		case 21:
+		case mavcmd_NAV_LAND:
 			action = "LAND"
-			p1 = 0
-			if q.alt == 0 {
-				q.alt = last_alt
-			}
-			if q.lat == 0.0 {
-				q.lat = last_lat
-			}
-			if q.lon == 0.0 {
-				q.lon = last_lon
+			p1 = speed
+			if q.fwa != nil {
+				if fwa != nil {
+					note(q, "only the last FW landing pattern is used")
+				}
+				fwa = q.fwa
 			}
-		case 177:
+
+		case mavcmd_DO_JUMP:
 			p1 = int16(q.params[0])
 			action = "JUMP"
 			p2 = int16(q.params[1])
@@ -625,10 +740,10 @@ func process_qgc(dat []byte, mtype string) *MultiMission {
 			q.lon = 0.0
 			have_jump = true
 
-		case 195, 201:
+		case mavcmd_DO_SET_ROI_LOCATION, mavcmd_DO_SET_ROI:
 			action = "SET_POI"
 
-		case 115:
+		case mavcmd_CONDITION_YAW:
 			p1 = int16(q.params[0])
 			act := int(q.params[3])
 			if p1 == 0 && act == 0 {
@@ -639,39 +754,144 @@ func process_qgc(dat []byte, mtype string) *MultiMission {
 			q.lon = 0
 			q.alt = 0
 
-		case 197:
+		case mavcmd_DO_SET_ROI_NONE:
 			p1 = -1
 			action = "SET_HEAD"
 			q.lat = 0
 			q.lon = 0
 			q.alt = 0
 
+		case mavcmd_DO_CHANGE_SPEED:
+			if q.params[1] > 0 {
+				speed = int16(q.params[1] * 100)
+			} else if q.params[1] == -2 {
+				speed = defspeed
+			}
+			ok = false
+
+		case mavcmd_DO_LAND_START:
+			note(q, "DO_LAND_START has no inav equivalent, the landing sequence follows")
+			ok = false
+
+		case mavcmd_DO_DIGICAM_CONTROL, mavcmd_DO_SET_SERVO:
+			bit := int16(wp_USER1)
+			desc := "camera"
+			if q.command == mavcmd_DO_SET_SERVO {
+				n := -1
+				for k, c := range servos {
+					if c == int(q.params[0]) {
+						n = k
+					}
+				}
+				if n == -1 {
+					n = len(servos)
+					servos = append(servos, int(q.params[0]))
+				}
+				if n > 2 {
+					note(q, "SET_SERVO %d dropped (no user action left)", int(q.params[0]))
+					ok = false
+					break
+				}
+				bit = int16(wp_USER2 << n)
+				desc = fmt.Sprintf("servo %d", int(q.params[0]))
+			}
+			// DO commands run on reaching the previous WP
+			k := len(mis) - 1
+			for k >= 0 && !mis[k].is_GeoPoint() {
+				k--
+			}
+			if k >= 0 {
+				uacts[k] |= bit
+				note(q, "%s approximated as user action %d on WP %d", desc, bits.TrailingZeros16(uint16(bit)), k+1)
+			} else {
+				pending |= bit
+				note(q, "%s approximated as user action %d on the first WP", desc, bits.TrailingZeros16(uint16(bit)))
+			}
+			ok = false
+
 		default:
+			unknown[q.command] = append(unknown[q.command], strconv.Itoa(q.jindex))
 			ok = false
 		}
-		if ok {
-			last_alt = q.alt
-			last_lat = q.lat
-			last_lon = q.lon
-			// P3 stores the original ID, which may not match No
-			p3 := int16(q.jindex)
-			no++
-			item := MissionItem{No: no, Lat: q.lat, Lon: q.lon, Alt: int32(q.alt), Action: action, P1: p1, P2: p2, P3: p3}
-			if item.is_GeoPoint() && q.altmode == 2 { // AMSL
-				item.P3 *= -1 // -ve P3 indicates amsl
+		if !ok {
+			dropped = append(dropped, q.jindex)
+			continue
+		}
+		switch q.command {
+		case mavcmd_NAV_LOITER_UNLIM, mavcmd_NAV_LOITER_TURNS, mavcmd_NAV_LOITER_TIME, mavcmd_NAV_LAND:
+			if q.alt == 0 && q.fwa == nil { // a landing pattern gives the land altitude
+				q.alt = last_alt
+			}
+			if q.lat == 0.0 {
+				q.lat = last_lat
 			}
-			mis = append(mis, item)
-			if last {
-				break
+			if q.lon == 0.0 {
+				q.lon = last_lon
+			}
+		}
+		last_alt = q.alt
+		last_lat = q.lat
+		last_lon = q.lon
+		for _, d := range dropped {
+			alias[d] = q.jindex
+		}
+		dropped = dropped[:0]
+		// P3 stores the original ID, which may not match No
+		p3 := int16(q.jindex)
+		no++
+		item := MissionItem{No: no, Lat: q.lat, Lon: q.lon, Alt: int32(q.alt), Action: action, P1: p1, P2: p2, P3: p3}
+		mis = append(mis, item)
+		// P3 bits (AMSL, user actions) are applied after the JUMP fixup
+		uact := int16(0)
+		if item.is_GeoPoint() {
+			uact, pending = pending, 0
+			if q.altmode == 2 { // AMSL
+				uact |= 1
 			}
 		}
+		uacts = append(uacts, uact)
+		if last {
+			if j < len(qs)-1 {
+				note(q, "%d items after RTL dropped", len(qs)-j-1)
+			}
+			break
+		}
+	}
+	cmds := []int{}
+	for c := range unknown {
+		cmds = append(cmds, c)
+	}
+	sort.Ints(cmds)
+	for _, c := range cmds {
+		fmt.Fprintf(os.Stderr, "QGC: MAV_CMD %d dropped (item %s)\n", c, strings.Join(unknown[c], ", "))
+	}
+	for j := range mis {
+		if tgt, ok := alias[int(mis[j].P1)]; ok && mis[j].Action == "JUMP" {
+			mis[j].P1 = int16(tgt)
+		}
 	}
 
 	mis, ok := fixup_qgc_mission(mis, have_jump)
 	if !ok {
-		log.Fatalf("Unsupported QGC file\n")
+		fmt.Fprintln(os.Stderr, "Unsupported QGC file")
+		return nil
 	}
-	return NewMultiMission(mis)
+	for j := range mis {
+		mis[j].P3 |= uacts[j]
+	}
+	mm := NewMultiMission(mis)
+	if home != nil {
+		mm.Segment[0].Metadata.Homey = home.lat
+		mm.Segment[0].Metadata.Homex = home.lon
+	}
+	if fwa != nil {
+		mm.Segment[0].FWApproach = *fwa
+	}
+	if qm != nil {
+		mm.Safehomes = qgc_safehomes(qm.RallyPoints)
+		mm.Geozones = qgc_geozones(qm.GeoFence)
+	}
+	return mm
 }
 
 func read_xml_mission(dat []byte) *MultiMission {
@@ -681,6 +901,9 @@ func read_xml_mission(dat []byte) *MultiMission {
 	buf := bytes.NewBuffer(dat)
 	dec := xml.NewDecoder(buf)
 	fwa := []FWApproach{}
+	svs := []SettingValue{}
+	shs := []Safehome{}
+	gzs := []Geozone{}
 
 	for {
 		t, _ := dec.Token()
@@ -705,6 +928,20 @@ func read_xml_mission(dat []byte) *MultiMission {
 				var f FWApproach
 				dec.DecodeElement(&f, &se)
 				fwa = append(fwa, f)
+			case "settings":
+			case "setting":
+				var sv SettingValue
+				dec.DecodeElement(&sv, &se)
+				svs = append(svs, sv)
+			case "safehomes", "geozones":
+			case "safehome":
+				var sh Safehome
+				dec.DecodeElement(&sh, &se)
+				shs = append(shs, sh)
+			case "geozone":
+				var gz Geozone
+				dec.DecodeElement(&gz, &se)
+				gzs = append(gzs, gz)
 			default:
 				fmt.Printf("Unknown MWXML tag %s\n", se.Name.Local)
 			}
@@ -712,6 +949,15 @@ func read_xml_mission(dat []byte) *MultiMission {
 	}
 	mm := NewMultiMission(mis)
 	mm.Version = v
+	if len(svs) > 0 {
+		mm.Settings = svs
+	}
+	if len(shs) > 0 {
+		mm.Safehomes = shs
+	}
+	if len(gzs) > 0 {
+		mm.Geozones = gzs
+	}
 	for j := range mm.Segment {
 		if j < len(mwps) {
 			mm.Segment[j].Metadata = mwps[j]
@@ -725,13 +971,18 @@ func read_xml_mission(dat []byte) *MultiMission {
 	return mm
 }
 
-func read_kmz(path string) (string, *MultiMission) {
-	r, err := zip.OpenReader(path)
+func read_kmz(dat []byte, path string) (string, *MultiMission) {
+	r, err := zip.NewReader(bytes.NewReader(dat), int64(len(dat)))
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintf(os.Stderr, "KMZ error: %v\n", err)
+		return "", nil
 	}
-	defer r.Close()
-	for _, f := range r.File {
+	// A DJI KMZ has a template.kml and the executable waylines.wpml
+	files := append([]*zip.File{}, r.File...)
+	sort.SliceStable(files, func(i, j int) bool {
+		return strings.HasSuffix(files[i].Name, ".wpml") && !strings.HasSuffix(files[j].Name, ".wpml")
+	})
+	for _, f := range files {
 		rc, err := f.Open()
 		defer rc.Close()
 		if err == nil {
@@ -764,12 +1015,40 @@ func read_json(dat []byte, flg int) *MultiMission {
 	}
 }
 
+// A CLI diff / dump, or a block written by To_cli; comment lines are optional
+func is_inav_cli(dat []byte) bool {
+	if bytes.HasPrefix(dat, []byte("# ")) {
+		return true
+	}
+	for _, ln := range strings.Split(string(dat), "\n") {
+		f := strings.Fields(ln)
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if f[0] == "wp" && len(f) == 10 {
+			return true
+		}
+	}
+	return false
+}
+
 func read_inav_cli(dat []byte) *MultiMission {
 	mis := []MissionItem{}
 	fwa := []FWApproach{}
+	svs := []SettingValue{}
+	var areas cli_area_reader
 	for _, ln := range strings.Split(string(dat), "\n") {
-		if strings.HasPrefix(ln, "wp ") {
-			parts := strings.Split(ln, " ")
+		ln = strings.TrimSpace(ln)
+		parts := strings.Fields(ln)
+		if len(parts) == 0 {
+			continue
+		}
+		switch parts[0] {
+		case "set":
+			if sv, ok := parse_setting_line(ln); ok {
+				svs = append(svs, sv)
+			}
+		case "wp":
 			if len(parts) == 10 {
 				no, _ := strconv.Atoi(parts[1])
 				iact, _ := strconv.Atoi(parts[2])
@@ -792,12 +1071,9 @@ func read_inav_cli(dat []byte) *MultiMission {
 					mis = append(mis, item)
 				}
 			}
-		}
 		// fwapproach <index> <Approach altitude> <Land altitude>
 		//				<Approach direction> <approach heading 1> <approach heading 2> <sea level>
-
-		if strings.HasPrefix(ln, "fwapproach ") {
-			parts := strings.Split(ln, " ")
+		case "fwapproach":
 			if len(parts) == 8 {
 				idx, _ := strconv.Atoi(parts[1])
 				if idx > 7 {
@@ -817,6 +1093,8 @@ func read_inav_cli(dat []byte) *MultiMission {
 					fwa = append(fwa, f)
 				}
 			}
+		case "safehome", "geozone":
+			areas.parse(parts)
 		}
 	}
 	mm := NewMultiMission(mis)
@@ -828,15 +1106,27 @@ func read_inav_cli(dat []byte) *MultiMission {
 		}
 
 	}
+	if len(svs) > 0 {
+		mm.Settings = svs
+	}
+	mm.Safehomes = areas.shs
+	mm.Geozones = areas.gzs
 	return mm
 }
 
 func handle_mission_data(dat []byte, path string) (string, *MultiMission) {
 	var m *MultiMission
 	mtype := "unknown"
+	head := len(dat)
+	if head > 100 {
+		head = 100
+	}
 	switch {
 	case bytes.HasPrefix(dat, []byte("<?xml")):
 		switch {
+		case is_wpml(dat):
+			m = read_wpml(dat)
+			mtype = "wpml"
 		case bytes.Contains(dat, []byte("<MISSION")),
 			bytes.Contains(dat, []byte("<mission")):
 			m = read_xml_mission(dat)
@@ -853,22 +1143,34 @@ func handle_mission_data(dat []byte, path string) (string, *MultiMission) {
 	case bytes.HasPrefix(dat, []byte("QGC WPL 110")):
 		mtype = "qgc-text"
 		m = process_qgc(dat, mtype)
+	case is_blackbox_csv(dat):
+		m = read_blackbox_csv(dat)
+		mtype = "blackbox"
+	case is_igc(dat):
+		m = read_igc(dat)
+		mtype = "igc"
+	case is_nmea(dat):
+		m = read_nmea(dat)
+		mtype = "nmea"
+	case is_litchi(dat):
+		m = read_litchi(dat)
+		mtype = "litchi"
 	case bytes.HasPrefix(dat, []byte("no,wp,lat,lon,alt,p1")),
 		bytes.HasPrefix(dat, []byte("wp,lat,lon,alt,p1")):
 		m = read_simple(dat)
 		mtype = "csv"
 	case bytes.HasPrefix(dat, []byte("PK\003\004")):
-		mtype, m = read_kmz(path)
+		mtype, m = read_kmz(dat, path)
 	case bytes.HasPrefix(dat, []byte(`{"meta":{`)):
 		mtype = "mwp-json-s"
 		m = read_json(dat, 0)
 	case bytes.HasPrefix(dat, []byte(`{"missions":[`)):
 		mtype = "mwp-json-m"
 		m = read_json(dat, 1)
-	case bytes.Contains(dat[0:100], []byte(`"fileType": "Plan"`)):
+	case bytes.Contains(dat[0:head], []byte(`"fileType": "Plan"`)):
 		mtype = "qgc-json"
 		m = process_qgc(dat, mtype)
-	case bytes.HasPrefix(dat, []byte("# ")):
+	case is_inav_cli(dat):
 		mtype = "inav cli"
 		m = read_inav_cli(dat)
 	default:
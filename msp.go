@@ -2,11 +2,14 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,8 +25,9 @@ const (
 	msp_WP_MISSION_SAVE = 19
 	msp_WP_GETINFO      = 20
 
-	msp_WP     = 118
-	msp_SET_WP = 209
+	msp_RAW_GPS = 106
+	msp_WP      = 118
+	msp_SET_WP  = 209
 
 	wp_BAD       = 182
 	msp_DEBUGMSG = 253
@@ -67,11 +71,26 @@ const (
 
 const SETTING_STR string = "nav_wp_multi_mission_index"
 
+const (
+	gps_FIX_3D   = 2
+	gps_MIN_SATS = 6
+)
+
 type MsgData struct {
 	ok   bool
 	cmd  uint16
 	len  uint16
 	data []byte
+	raw  []byte
+}
+
+type GPSInfo struct {
+	fix  uint8
+	nsat uint8
+	lat  float64
+	lon  float64
+	alt  int16
+	hdop uint16
 }
 
 type SerDev interface {
@@ -80,18 +99,43 @@ type SerDev interface {
 	Close() error
 }
 
+type FCInfo struct {
+	Variant string `json:"variant"`
+	Version string `json:"version"`
+	Board   string `json:"board"`
+	Git     string `json:"git"`
+	Api     string `json:"api"`
+	Name    string `json:"name"`
+	WpMax   int    `json:"wp_max"`
+	WpCount int    `json:"wp_count"`
+	WpValid int    `json:"wp_valid"`
+}
+
+type MSPError string
+
+func (e MSPError) Error() string {
+	return string(e)
+}
+
 type MSPSerial struct {
-	sd     SerDev
-	c0     chan MsgData
-	packet bool
+	sd          SerDev
+	c0          chan MsgData
+	packet      bool
+	keepraw     bool // MsgData includes the raw frame
+	client      bool // reads MSP requests from a proxy / bridge client
+	recoverable bool // fatal errors panic rather than exit
+	keepwp      bool // Init keeps the volatile mission (no MISSION_LOAD)
+	info        FCInfo
+	v2          bool          // FC supports MSPv2
+	fcvers      uint32        // FC version, as 0xMMmmpp
+	msgs        io.Writer     // progress messages (stderr if nil)
+	nowp        bool          // FC does not support the MSP WP commands
+	cli         atomic.Bool   // in the CLI, input is text (to txt)
+	txt         chan []byte   // CLI text, closed if the link is lost
+	cliwp       *MultiMission // FC mission listed by a CLI upload
 }
 
-var (
-	Wp_count byte
-	use_v2   bool
-	dumphex  bool
-	fcvers   uint32
-)
+var dumphex bool
 
 func crc8_dvb_s2(crc byte, a byte) byte {
 	crc ^= a
@@ -161,6 +205,7 @@ func (m *MSPSerial) Read_msp(c0 chan MsgData) {
 	var crc = byte(0)
 	req := 1
 	n := state_INIT
+	raw := []byte{}
 
 	for {
 		if m.packet {
@@ -170,8 +215,19 @@ func (m *MSPSerial) Read_msp(c0 chan MsgData) {
 		if err == nil {
 			if nb == 0 {
 				time.Sleep(100 * time.Microsecond)
+			} else if m.cli.Load() {
+				capture.Log("RX", inp[:nb])
+				m.txt <- append([]byte{}, inp[:nb]...)
+				n = state_INIT
+				req = len(inp) // text is read as it arrives
 			} else {
 				for i := 0; i < nb; i++ {
+					if capture != nil || m.keepraw || m.client {
+						if n == state_INIT {
+							raw = raw[:0]
+						}
+						raw = append(raw, inp[i])
+					}
 					switch n {
 					case state_INIT:
 						if inp[i] == '$' {
@@ -191,7 +247,7 @@ func (m *MSPSerial) Read_msp(c0 chan MsgData) {
 					case state_DIRN:
 						if inp[i] == '!' {
 							n = state_LEN
-						} else if inp[i] == '>' {
+						} else if inp[i] == '>' || (m.client && inp[i] == '<') {
 							n = state_LEN
 							sc.ok = true
 						} else {
@@ -201,7 +257,7 @@ func (m *MSPSerial) Read_msp(c0 chan MsgData) {
 					case state_X_HEADER2:
 						if inp[i] == '!' {
 							n = state_X_FLAGS
-						} else if inp[i] == '>' {
+						} else if inp[i] == '>' || (m.client && inp[i] == '<') {
 							n = state_X_FLAGS
 							sc.ok = true
 						} else {
@@ -248,10 +304,16 @@ func (m *MSPSerial) Read_msp(c0 chan MsgData) {
 						}
 
 					case state_X_CHECKSUM:
+						if !m.client {
+							capture.Log("RX", raw)
+						}
 						ccrc := inp[i]
 						if crc != ccrc {
 							fmt.Fprintf(os.Stderr, "CRC error on %d\n", sc.cmd)
 						} else {
+							if m.keepraw || m.client {
+								sc.raw = append([]byte{}, raw...)
+							}
 							c0 <- sc
 						}
 						n = state_INIT
@@ -280,10 +342,16 @@ func (m *MSPSerial) Read_msp(c0 chan MsgData) {
 							req = 1
 						}
 					case state_CRC:
+						if !m.client {
+							capture.Log("RX", raw)
+						}
 						ccrc := inp[i]
 						if crc != ccrc {
 							fmt.Fprintf(os.Stderr, "CRC error on %d\n", sc.cmd)
 						} else {
+							if m.keepraw || m.client {
+								sc.raw = append([]byte{}, raw...)
+							}
 							//						fmt.Fprintf(os.Stderr, "Cmd %v Len %v\n", sc.cmd, sc.len)
 							c0 <- sc
 						}
@@ -292,24 +360,44 @@ func (m *MSPSerial) Read_msp(c0 chan MsgData) {
 				}
 			}
 		} else {
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Read %v\n", err)
-			} else {
-				fmt.Fprintln(os.Stderr, "serial EOF")
-			}
 			m.sd.Close()
-			os.Exit(2)
+			if m.cli.Load() { // save / exit reboots the FC
+				close(m.txt)
+				close(c0)
+				return
+			}
+			if !m.client {
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Read %v\n", err)
+				} else {
+					fmt.Fprintln(os.Stderr, "serial EOF")
+				}
+			}
+			if m.client || m.recoverable {
+				close(c0)
+				return
+			}
+			os.Exit(EXIT_FC)
 		}
 	}
 }
 
-func NewMSPSerial(dd DevDescription) *MSPSerial {
+func NewMSPSerial(dd DevDescription) (*MSPSerial, error) {
 	switch dd.klass {
 	case DevClass_SERIAL:
 		return open_serial_port(dd)
 	case DevClass_BT:
-		bt := NewBT(dd.name)
-		return &MSPSerial{packet: false, sd: bt}
+		bt, err := NewBT(dd.name)
+		if err != nil {
+			return nil, err
+		}
+		return &MSPSerial{packet: false, sd: bt}, nil
+	case DevClass_REPLAY:
+		r, err := NewReplay(dd.name)
+		if err != nil {
+			return nil, err
+		}
+		return &MSPSerial{packet: false, sd: r}, nil
 	case DevClass_TCP:
 		var conn net.Conn
 		remote := fmt.Sprintf("%s:%d", dd.name, dd.param)
@@ -318,9 +406,9 @@ func NewMSPSerial(dd DevDescription) *MSPSerial {
 			conn, err = net.DialTCP("tcp", nil, addr)
 		}
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		return &MSPSerial{packet: false, sd: conn}
+		return &MSPSerial{packet: false, sd: conn}, nil
 	case DevClass_UDP:
 		var laddr, raddr *net.UDPAddr
 		var conn net.Conn
@@ -339,51 +427,104 @@ func NewMSPSerial(dd DevDescription) *MSPSerial {
 			conn, err = net.DialUDP("udp", laddr, raddr)
 		}
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		return &MSPSerial{packet: true, sd: conn}
+		return &MSPSerial{packet: true, sd: conn}, nil
 	default:
-		fmt.Fprintln(os.Stderr, "Unsupported device")
-		os.Exit(1)
+		return nil, errors.New("Unsupported device")
+	}
+}
+
+func (m *MSPSerial) write(buf []byte) {
+	capture.Log("TX", buf)
+	m.sd.Write(buf)
+}
+
+// Fatal errors exit, unless the session is recoverable, when they panic
+// with an MSPError for the caller to recover
+func (m *MSPSerial) fatal(msg string) {
+	if m.recoverable {
+		panic(MSPError(msg))
+	}
+	log.Println(msg)
+	os.Exit(EXIT_FC)
+}
+
+// Reports progress; sessions may share stderr (or be quiet) by setting msgs
+func (m *MSPSerial) printf(format string, a ...interface{}) {
+	if m.msgs != nil {
+		fmt.Fprintf(m.msgs, format, a...)
+	} else {
+		fmt.Fprintf(os.Stderr, format, a...)
 	}
-	return nil
 }
 
 func (m *MSPSerial) Send_msp(cmd uint16, payload []byte) {
 	buf := encode_msp(cmd, payload)
-	m.sd.Write(buf)
+	m.write(buf)
 }
 
 func (m *MSPSerial) Wait_msp(cmd uint16, payload []byte) MsgData {
 	var buf []byte
-	if use_v2 || cmd > 255 {
+	if m.v2 || cmd > 255 {
 		buf = encode_msp2(cmd, payload)
 	} else {
 		buf = encode_msp(cmd, payload)
 	}
-	m.sd.Write(buf)
+	m.write(buf)
 
 	var v MsgData
+	var ok bool
 	for done := false; !done; {
 		select {
-		case v = <-m.c0:
+		case v, ok = <-m.c0:
+			if !ok {
+				m.fatal("MSP device closed")
+			}
 			if v.cmd == cmd {
 				done = true
 			}
 		case <-time.After(time.Second * 5):
-			log.Fatalln("MSP timeout")
+			m.fatal("MSP timeout")
 		}
 	}
 	return v
 }
 
+func open_capture() {
+	dumphex = os.Getenv("IMPLOAD_DUMPHEX") != ""
+	if *capfile != "" && capture == nil {
+		var err error
+		if capture, err = NewCapture(*capfile); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
 func MSPInit(dd DevDescription) *MSPSerial {
-	var fw, api, vers, board, gitrev string
+	return init_msp(dd, false)
+}
 
-	dumphex = os.Getenv("IMPLOAD_DUMPHEX") != ""
+// As MSPInit, but the FC's volatile mission is kept rather than replaced by
+// the EEPROM mission
+func MSPInitVolatile(dd DevDescription) *MSPSerial {
+	return init_msp(dd, true)
+}
 
-	m := NewMSPSerial(dd)
+func init_msp(dd DevDescription, keepwp bool) *MSPSerial {
+	open_capture()
+	m, err := NewMSPSerial(dd)
+	if err != nil {
+		log.Println(err)
+		os.Exit(EXIT_FC)
+	}
+	m.keepwp = keepwp
+	m.Init()
+	return m
+}
 
+// Identifies the FC and its extant mission
+func (m *MSPSerial) Init() {
 	m.c0 = make(chan MsgData)
 	go m.Read_msp(m.c0)
 
@@ -391,39 +532,43 @@ func MSPInit(dd DevDescription) *MSPSerial {
 
 	for done := false; !done; {
 		select {
-		case v := <-m.c0:
+		case v, ok := <-m.c0:
+			if !ok {
+				m.fatal("MSP device closed")
+			}
 			switch v.cmd {
 			case msp_API_VERSION:
 				if v.len > 2 {
-					api = fmt.Sprintf("%d.%d", v.data[1], v.data[2])
-					use_v2 = (v.data[1] == 2)
+					m.info.Api = fmt.Sprintf("%d.%d", v.data[1], v.data[2])
+					m.v2 = (v.data[1] == 2)
 					m.Send_msp(msp_FC_VARIANT, nil)
 				}
 			case msp_FC_VARIANT:
-				fw = string(v.data[0:4])
+				m.info.Variant = string(v.data[0:4])
 				m.Send_msp(msp_FC_VERSION, nil)
 			case msp_FC_VERSION:
-				fcvers = uint32(v.data[0])<<16 | uint32(v.data[1])<<8 | uint32(v.data[2])
-				vers = fmt.Sprintf("%d.%d.%d", v.data[0], v.data[1], v.data[2])
+				m.fcvers = uint32(v.data[0])<<16 | uint32(v.data[1])<<8 | uint32(v.data[2])
+				m.info.Version = fmt.Sprintf("%d.%d.%d", v.data[0], v.data[1], v.data[2])
 				m.Send_msp(msp_BUILD_INFO, nil)
 			case msp_BUILD_INFO:
-				gitrev = string(v.data[19:])
+				m.info.Git = string(v.data[19:])
 				m.Send_msp(msp_BOARD_INFO, nil)
 			case msp_BOARD_INFO:
 				if v.len > 8 {
-					board = string(v.data[9:])
+					m.info.Board = string(v.data[9:])
 				} else {
-					board = string(v.data[0:4])
+					m.info.Board = string(v.data[0:4])
 				}
-				fmt.Fprintf(os.Stderr, "%s v%s %s (%s) API %s", fw, vers, board, gitrev, api)
 				m.Send_msp(msp_NAME, nil)
 			case msp_NAME:
+				m.printf("%s v%s %s (%s) API %s", m.info.Variant, m.info.Version, m.info.Board, m.info.Git, m.info.Api)
 				if v.len > 0 {
-					fmt.Fprintf(os.Stderr, " \"%s\"\n", v.data)
+					m.info.Name = string(v.data)
+					m.printf(" \"%s\"\n", v.data)
 				} else {
-					fmt.Fprintln(os.Stderr)
+					m.printf("\n")
 				}
-				if Wp_count == 0 {
+				if m.info.WpCount == 0 && !m.keepwp {
 					z := make([]byte, 1)
 					z[0] = 1
 					m.Send_msp(msp_WP_MISSION_LOAD, z)
@@ -433,21 +578,28 @@ func MSPInit(dd DevDescription) *MSPSerial {
 			case msp_WP_MISSION_LOAD:
 				m.Send_msp(msp_WP_GETINFO, nil)
 			case msp_WP_GETINFO:
-				wp_max := v.data[1]
-				MaxWP = int(wp_max)
-				wp_valid := v.data[2]
-				Wp_count = v.data[3]
-				fmt.Fprintf(os.Stderr, "Extant waypoints in FC: %d of %d, valid %d\n", Wp_count, wp_max, wp_valid)
+				if !v.ok || v.len < 4 {
+					m.printf("MSP WP commands unavailable, missions are transferred via the CLI\n")
+					m.nowp = true
+					m.info.WpMax = DEFAULT_MAX_WP
+					done = true
+					break
+				}
+				m.info.WpMax = int(v.data[1])
+				m.info.WpValid = int(v.data[2])
+				m.info.WpCount = int(v.data[3])
+				m.printf("Extant waypoints in FC: %d of %d, valid %d\n", m.info.WpCount, m.info.WpMax, m.info.WpValid)
 				done = true
 			case msp_DEBUGMSG:
 				str := strings.Trim(string(v.data), "\x00\t\r\n ")
-				fmt.Fprintf(os.Stderr, "Debug: %s\n", str)
+				m.printf("Debug: %s\n", str)
 			default:
-				fmt.Fprintf(os.Stderr, "Unsolicited %d, length %d\n", v.cmd, v.len)
+				m.printf("Unsolicited %d, length %d\n", v.cmd, v.len)
 			}
+		case <-time.After(time.Second * 5):
+			m.fatal("MSP timeout")
 		}
 	}
-	return m
 }
 
 func Decode_action(b byte) string {
@@ -552,15 +704,25 @@ func hexdump(buf []byte) {
 }
 
 func (m *MSPSerial) download(eeprom bool) *MultiMission {
+	if m.nowp && m.cliwp == nil {
+		if err := m.cli_list(eeprom); err != nil {
+			m.fatal(err.Error())
+		}
+	}
+	if m.cliwp != nil { // the FC rebooted on leaving the CLI
+		return m.cliwp
+	}
 	if eeprom {
 		z := make([]byte, 1)
 		z[0] = 1
 		m.Wait_msp(msp_WP_MISSION_LOAD, z)
-		fmt.Fprintf(os.Stderr, "Restored mission\n")
+		m.printf("Restored mission\n")
 	}
 
-	v := m.Wait_msp(msp_WP_GETINFO, nil)
-	wp_count := v.data[3]
+	if !m.wp_getinfo() {
+		m.fatal("MSP WP_GETINFO failed")
+	}
+	wp_count := byte(m.info.WpCount)
 	var mis = []MissionItem{}
 	if wp_count > 0 {
 		z := make([]byte, 1)
@@ -576,7 +738,13 @@ func (m *MSPSerial) download(eeprom bool) *MultiMission {
 		}
 	}
 	var mm = NewMultiMission(mis)
-	if fcvers >= 0x70100 {
+	if hlat, hlon, ok := m.get_home(); ok {
+		for j := range mm.Segment {
+			mm.Segment[j].Metadata.Homey = hlat
+			mm.Segment[j].Metadata.Homex = hlon
+		}
+	}
+	if m.fcvers >= 0x70100 {
 		for j := range mm.Segment {
 			var z = make([]byte, 1)
 			z[0] = byte(j) + 8
@@ -628,8 +796,12 @@ func deserialise_wp(b []byte) (bool, MissionItem) {
 	return last, item
 }
 
-func (s *MSPSerial) upload(mm *MultiMission, eeprom bool) {
-	if mm.is_valid() {
+// Returns true if the FC reports the uploaded mission as complete and valid
+func (s *MSPSerial) upload(mm *MultiMission, eeprom bool) bool {
+	if s.use_cli() {
+		return s.cli_upload(mm)
+	}
+	if mm.valid_for(s.info.WpMax) {
 
 		i := 0
 		for _, ms := range mm.Segment {
@@ -638,7 +810,7 @@ func (s *MSPSerial) upload(mm *MultiMission, eeprom bool) {
 				i++
 				v.No = i
 				if *verbose == false {
-					fmt.Fprintf(os.Stderr, "Upload %d\r", i)
+					s.printf("Upload %d\r", i)
 				}
 				_, b := serialise_wp(v, (i == mlen))
 				if *verbose {
@@ -649,13 +821,13 @@ func (s *MSPSerial) upload(mm *MultiMission, eeprom bool) {
 					fmt.Fprintf(os.Stderr, "Buf %d %d\n", b[0], b[20])
 				}
 			}
-			if fcvers >= 0x70100 && ms.FWApproach.No > 7 {
+			if s.fcvers >= 0x70100 && ms.FWApproach.No > 7 {
 				_, b := serialise_fwa(ms.FWApproach)
 				s.Wait_msp(msp_SET_FW_APPROACH, b)
-				fmt.Fprintf(os.Stderr, "upload FWApproach %d/%d\n", ms.FWApproach.Index, ms.FWApproach.No)
+				s.printf("upload FWApproach %d/%d\n", ms.FWApproach.Index, ms.FWApproach.No)
 			}
 		}
-		fmt.Fprintf(os.Stderr, "upload %d, save %v\n", i, eeprom)
+		s.printf("upload %d, save %v\n", i, eeprom)
 
 		if eeprom {
 			z := make([]byte, 1)
@@ -663,35 +835,103 @@ func (s *MSPSerial) upload(mm *MultiMission, eeprom bool) {
 			t := time.Now()
 			s.Wait_msp(msp_WP_MISSION_SAVE, z)
 			et := time.Since(t)
-			fmt.Fprintf(os.Stderr, "Saved mission (%s)\n", et)
+			s.printf("Saved mission (%s)\n", et)
+		}
+		if !s.wp_getinfo() {
+			s.printf("MSP WP_GETINFO failed\n")
+			return false
 		}
-		v := s.Wait_msp(msp_WP_GETINFO, nil)
-		wp_max := v.data[1]
-		wp_valid := v.data[2]
-		wp_count := v.data[3]
-		fmt.Fprintf(os.Stderr, "Waypoints: %d of %d, valid %d\n", wp_count, wp_max, wp_valid)
+		s.printf("Waypoints: %d of %d, valid %d\n", s.info.WpCount, s.info.WpMax, s.info.WpValid)
+		return s.info.WpCount == i && s.info.WpValid == 1
 	} else {
-		fmt.Fprintf(os.Stderr, "Mission fails verification, upload cancelled\n")
+		for _, p := range mm.validate(s.info.WpMax) {
+			s.printf("  %s\n", p)
+		}
+		s.printf("Mission fails verification, upload cancelled\n")
+		return false
+	}
+}
+
+// Refreshes the FC's WP counts
+func (s *MSPSerial) wp_info() FCInfo {
+	if s.nowp && s.cliwp == nil {
+		if err := s.cli_list(false); err != nil {
+			s.fatal(err.Error())
+		}
+	}
+	if s.cliwp != nil {
+		return s.info
+	}
+	if !s.wp_getinfo() {
+		s.fatal("MSP WP_GETINFO failed")
+	}
+	return s.info
+}
+
+// Reads the WP counts; an FC without the MSP WP commands sends an error (or
+// empty) reply
+func (s *MSPSerial) wp_getinfo() bool {
+	v := s.Wait_msp(msp_WP_GETINFO, nil)
+	if !v.ok || v.len < 4 {
+		return false
 	}
+	s.info.WpMax = int(v.data[1])
+	s.info.WpValid = int(v.data[2])
+	s.info.WpCount = int(v.data[3])
+	return true
 }
 
 func (m *MSPSerial) get_multi_index() {
-	lstr := len(SETTING_STR)
-	buf := make([]byte, lstr+1)
-	copy(buf, SETTING_STR)
-	buf[lstr] = 0
-	v := m.Wait_msp(msp_COMMON_SETTING, buf)
-	if v.len > 0 {
-		fmt.Fprintf(os.Stderr, "Multi index %d\n", v.data[0])
-	}
-}
-
-func (m *MSPSerial) set_multi_index(idx uint8) {
-	lstr := len(SETTING_STR)
-	buf := make([]byte, lstr+2)
-	copy(buf, SETTING_STR)
-	buf[lstr] = 0
-	buf[lstr+1] = idx
-	m.Wait_msp(msp_COMMON_SET_SETTING, buf)
-	m.Wait_msp(msp_EEPROM_WRITE, nil)
+	si, err := m.get_setting_info(SETTING_STR)
+	if err == nil {
+		m.printf("Multi index %s\n", si.format_value())
+	} else {
+		m.printf("%v\n", err)
+	}
+}
+
+func (m *MSPSerial) get_gps() GPSInfo {
+	var g GPSInfo
+	v := m.Wait_msp(msp_RAW_GPS, nil)
+	if v.len >= 16 {
+		g.fix = v.data[0]
+		g.nsat = v.data[1]
+		g.lat = float64(int32(binary.LittleEndian.Uint32(v.data[2:6]))) / 1e7
+		g.lon = float64(int32(binary.LittleEndian.Uint32(v.data[6:10]))) / 1e7
+		g.alt = int16(binary.LittleEndian.Uint16(v.data[10:12]))
+		if v.len >= 18 {
+			g.hdop = binary.LittleEndian.Uint16(v.data[16:18])
+		}
+	}
+	return g
+}
+
+// WP#0 is the home location in inav; zero if home is not (yet) set
+func (m *MSPSerial) get_home() (float64, float64, bool) {
+	z := make([]byte, 1)
+	v := m.Wait_msp(msp_WP, z)
+	if v.len >= 21 {
+		_, mi := deserialise_wp(v.data)
+		if mi.Lat != 0 || mi.Lon != 0 {
+			return mi.Lat, mi.Lon, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Prefers the stored home, otherwise a good quality GPS fix
+func (m *MSPSerial) fc_location() (float64, float64, error) {
+	if lat, lon, ok := m.get_home(); ok {
+		m.printf("Using FC home %.7f %.7f\n", lat, lon)
+		return lat, lon, nil
+	}
+	g := m.get_gps()
+	if g.fix < gps_FIX_3D {
+		return 0, 0, fmt.Errorf("no 3D GPS fix (fix type %d)", g.fix)
+	}
+	if g.nsat < gps_MIN_SATS {
+		return 0, 0, fmt.Errorf("insufficient satellites (%d, need %d)", g.nsat, gps_MIN_SATS)
+	}
+	m.printf("Using FC GPS %.7f %.7f (%d sats, hdop %.2f)\n", g.lat, g.lon, g.nsat, float64(g.hdop)/100.0)
+	return g.lat, g.lon, nil
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"path"
@@ -48,7 +49,9 @@ func evince_zoom(bbox BBox) int {
 	return z
 }
 
-func (mm *MultiMission) Update_mission_meta() {
+// Numbers the WPs and sets the segment metadata, after moving the mission
+// to rb ("lat,lon[,wpno,segno]") if that is set
+func (mm *MultiMission) Update_mission_meta(rb string) {
 	brg := 0.0
 	rng := 0.0
 	var blat float64
@@ -58,8 +61,8 @@ func (mm *MultiMission) Update_mission_meta() {
 	bidx := 0
 	bseg := 0
 
-	if *rebase != "" {
-		offsets := strings.Split(*rebase, ",")
+	if rb != "" {
+		offsets := strings.Split(rb, ",")
 		blat, _ = strconv.ParseFloat(offsets[0], 64)
 		blon, _ = strconv.ParseFloat(offsets[1], 64)
 		if len(offsets) >= 3 {
@@ -82,13 +85,16 @@ func (mm *MultiMission) Update_mission_meta() {
 			os.Exit(127)
 		}
 	}
+	if rb != "" {
+		mm.rebase_areas(blat0, blon0, blat, blon)
+	}
 	ino := 1
 	for i := range mm.Segment {
 		if *outfmt != "xml-ugly" {
 			ino = 1
 		}
 
-		if *rebase != "" {
+		if rb != "" {
 			brg, rng = geo.Csedist(blat0, blon0, mm.Segment[i].Metadata.Homey, mm.Segment[i].Metadata.Homex)
 			mm.Segment[i].Metadata.Homey, mm.Segment[i].Metadata.Homex = geo.Posit(blat, blon, brg, rng)
 		}
@@ -114,7 +120,7 @@ func (mm *MultiMission) Update_mission_meta() {
 					}
 				}
 
-				if *rebase != "" {
+				if rb != "" {
 					brg, rng = geo.Csedist(blat0, blon0, mm.Segment[i].MissionItems[j].Lat, mm.Segment[i].MissionItems[j].Lon)
 					mm.Segment[i].MissionItems[j].Lat, mm.Segment[i].MissionItems[j].Lon = geo.Posit(blat, blon, brg, rng)
 				}
@@ -172,94 +178,115 @@ func xml_comment(params []string) string {
 	return sb.String()
 }
 
-func (mm *MultiMission) To_xml(params ...string) {
+func (mm *MultiMission) To_xml(w io.Writer, params ...string) {
 	mm.Comment = xml_comment(params)
-	mm.Update_mission_meta()
-	w, err := openStdoutOrFile(params[0])
-	if err == nil {
-		xs, _ := xml.MarshalIndent(mm, "", " ")
-		fmt.Fprint(w, xml.Header)
-		fmt.Fprintln(w, string(xs))
-	}
+	mm.Update_mission_meta(given_rebase())
+	xs, _ := xml.MarshalIndent(mm, "", " ")
+	fmt.Fprint(w, xml.Header)
+	fmt.Fprintln(w, string(xs))
 }
 
-func (mm *MultiMission) To_json(fname string) {
-	w, err := openStdoutOrFile(fname)
-	if err == nil {
-		defer w.Close()
-		mm.Update_mission_meta()
-		js, _ := json.Marshal(mm)
-		fmt.Fprintln(w, string(js))
-	}
+func (mm *MultiMission) To_json(w io.Writer) {
+	mm.Update_mission_meta(given_rebase())
+	js, _ := json.Marshal(mm)
+	fmt.Fprintln(w, string(js))
 }
 
-func (mm *MultiMission) To_cli(fname string) {
-	w, err := openStdoutOrFile(fname)
-	if err == nil {
-		defer w.Close()
-		fmt.Fprintln(w, "# wp load")
-		nmi := 0
-		for _, m := range mm.Segment {
-			nmi += len(m.MissionItems)
+// A block that may be pasted into the inav CLI (and is read by
+// read_inav_cli). CLI WP numbers, and JUMP targets, are 0 based.
+func (mm *MultiMission) To_cli(w io.Writer) {
+	nmi := 0
+	for _, m := range mm.Segment {
+		nmi += len(m.MissionItems)
+	}
+	valid := ""
+	if !mm.is_valid() {
+		valid = "in"
+	}
+	fmt.Fprintln(w, "# waypoints")
+	fmt.Fprintf(w, "#wp %d %svalid\n", nmi, valid)
+	fmt.Fprintln(w, "wp reset")
+	no := 0
+	for _, m := range mm.Segment {
+		for _, mi := range m.MissionItems {
+			ilat := int(mi.Lat * 1e7)
+			ilon := int(mi.Lon * 1e7)
+			ialt := int(mi.Alt * 100)
+			iact := Encode_action(mi.Action)
+			if iact == 6 {
+				mi.P1--
+			}
+			fmt.Fprintf(w, "wp %d %d %d %d %d %d %d %d %d\n",
+				no, iact, ilat, ilon, ialt, mi.P1, mi.P2, mi.P3, mi.Flag)
+			no++
 		}
-
-		fmt.Fprintf(w, "#wp %d valid\n", nmi)
-		no := 1
-		for _, m := range mm.Segment {
-			for _, mi := range m.MissionItems {
-				ilat := int(mi.Lat * 1e7)
-				ilon := int(mi.Lon * 1e7)
-				ialt := int(mi.Alt * 100)
-				iact := Encode_action(mi.Action)
-				if iact == 6 {
-					mi.P1--
-				}
-				fmt.Fprintf(w, "wp %d %d %d %d %d %d %d %d %d\n",
-					no, iact, ilat, ilon, ialt, mi.P1, mi.P2, mi.P3, mi.Flag)
-				no++
+	}
+	hdr := false
+	for _, m := range mm.Segment {
+		if has_fwapproach(m.FWApproach) {
+			if !hdr {
+				fmt.Fprintln(w, "# fwapproach")
+				hdr = true
 			}
+			fmt.Fprintln(w, cli_fwapproach(m.FWApproach))
 		}
 	}
+	mm.cli_areas(w)
+	for _, sv := range mm.Settings {
+		fmt.Fprintf(w, "set %s = %s\n", sv.Name, sv.Value)
+	}
+	fmt.Fprintln(w, "save")
 }
 
-func (mm *MultiMission) To_md(params ...string) {
-	w, err := openStdoutOrFile(params[0])
-	if err == nil {
-		defer w.Close()
+// fwapproach <index> <approach alt> <land alt> <approach direction>
+//
+//	<approach heading 1> <approach heading 2> <sea level>
+func cli_fwapproach(f FWApproach) string {
+	dirn := 0
+	if f.Dref == "right" {
+		dirn = 1
+	}
+	aref := 0
+	if f.Aref {
+		aref = 1
+	}
+	return fmt.Sprintf("fwapproach %d %d %d %d %d %d %d", f.No, f.Appalt, f.Landalt, dirn, f.Dirn1, f.Dirn2, aref)
+}
 
-		mm.Comment = xml_comment(params)
+func (mm *MultiMission) To_md(w io.Writer, params ...string) {
+	mm.Comment = xml_comment(params)
 
-		fmt.Fprintln(w, "## Mission Details")
+	fmt.Fprintln(w, "## Mission Details")
 
-		for j, m := range mm.Segment {
-			fmt.Fprintln(w)
-			fmt.Fprintf(w, "### Segment %d\n", j+1)
-			fmt.Fprintln(w)
-			fmt.Fprintln(w, "|      |              |")
-			fmt.Fprintln(w, "| ---- | ------------ |")
-			fmt.Fprintf(w, "| Generator | %s |\n", m.Metadata.Generator)
-			fmt.Fprintf(w, "| Save date | %s |\n", m.Metadata.Stamp)
-			if m.Metadata.Homey != 0 && m.Metadata.Homex != 0 {
-				fmt.Fprintf(w, "| Planned Home | %.7f %.7f |\n", m.Metadata.Homey, m.Metadata.Homex)
-			}
-			if m.Metadata.Cy != 0 && m.Metadata.Cx != 0 {
-				fmt.Fprintf(w, "| Centre on | %.7f %.7f |\n", m.Metadata.Cy, m.Metadata.Cx)
-			}
+	for j, m := range mm.Segment {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "### Segment %d\n", j+1)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "|      |              |")
+		fmt.Fprintln(w, "| ---- | ------------ |")
+		fmt.Fprintf(w, "| Generator | %s |\n", m.Metadata.Generator)
+		fmt.Fprintf(w, "| Save date | %s |\n", m.Metadata.Stamp)
+		if m.Metadata.Homey != 0 && m.Metadata.Homex != 0 {
+			fmt.Fprintf(w, "| Planned Home | %.7f %.7f |\n", m.Metadata.Homey, m.Metadata.Homex)
+		}
+		if m.Metadata.Cy != 0 && m.Metadata.Cx != 0 {
+			fmt.Fprintf(w, "| Centre on | %.7f %.7f |\n", m.Metadata.Cy, m.Metadata.Cx)
+		}
 
-			fmt.Fprintln(w)
-			fmt.Fprintln(w, "| WP# | Action | Lat | Lon | Alt | P1 | P2 | P3 | flag |")
-			fmt.Fprintln(w, "| ---- | ------ | ---- | ---- | ---- | ---- | ---- | ---- | ---- |")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "| WP# | Action | Lat | Lon | Alt | P1 | P2 | P3 | flag |")
+		fmt.Fprintln(w, "| ---- | ------ | ---- | ---- | ---- | ---- | ---- | ---- | ---- |")
 
-			no := 1
-			for _, mi := range m.MissionItems {
-				fmt.Fprintf(w, "| %d | %s | %.7f | %.7f | %d | %d | %d | %d | %d |\n",
-					no, mi.Action, mi.Lat, mi.Lon, mi.Alt, mi.P1, mi.P2, mi.P3, mi.Flag)
-				no++
-			}
-		}
-		if len(mm.Comment) > 0 {
-			fmt.Fprintln(w)
-			fmt.Fprintln(w, mm.Comment)
+		no := 1
+		for _, mi := range m.MissionItems {
+			fmt.Fprintf(w, "| %d | %s | %.7f | %.7f | %d | %d | %d | %d | %d |\n",
+				no, mi.Action, mi.Lat, mi.Lon, mi.Alt, mi.P1, mi.P2, mi.P3, mi.Flag)
+			no++
 		}
 	}
+	mm.md_areas(w)
+	if len(mm.Comment) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, mm.Comment)
+	}
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const PROXY_TIMEOUT = 2 * time.Second
+
+type ProxyRequest struct {
+	cmd   uint16
+	raw   []byte
+	reply chan MsgData
+}
+
+// Opens the FC link, retrying until the device is available
+func open_fc_link(dd DevDescription) *MSPSerial {
+	for reported := false; ; {
+		fc, err := NewMSPSerial(dd)
+		if err == nil {
+			fc.keepraw = true
+			fc.recoverable = true
+			fc.c0 = make(chan MsgData)
+			go fc.Read_msp(fc.c0)
+			fmt.Fprintf(os.Stderr, "Proxy: FC connected (%s)\n", *device)
+			return fc
+		}
+		if !reported {
+			fmt.Fprintf(os.Stderr, "Proxy: %v, retrying\n", err)
+			reported = true
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Owns the FC link; requests are sent one at a time and the reply with the
+// same command ID is returned to the requester. Unsolicited messages are
+// discarded. If the FC link fails, it is reopened.
+func run_proxy(dd DevDescription, reqs chan ProxyRequest) {
+	fc := open_fc_link(dd)
+	for {
+		select {
+		case r := <-reqs:
+			fc.write(r.raw)
+			timeout := time.After(PROXY_TIMEOUT)
+			for waiting := true; waiting; {
+				select {
+				case v, ok := <-fc.c0:
+					if !ok {
+						r.reply <- MsgData{}
+						fc = open_fc_link(dd)
+						waiting = false
+					} else if v.cmd == r.cmd {
+						r.reply <- v
+						waiting = false
+					} else if *verbose {
+						fmt.Fprintf(os.Stderr, "Proxy: discard %d awaiting %d\n", v.cmd, r.cmd)
+					}
+				case <-timeout:
+					if *verbose {
+						fmt.Fprintf(os.Stderr, "Proxy: no reply to %d\n", r.cmd)
+					}
+					r.reply <- MsgData{}
+					waiting = false
+				}
+			}
+		case v, ok := <-fc.c0:
+			if !ok {
+				fc = open_fc_link(dd)
+			} else if *verbose {
+				fmt.Fprintf(os.Stderr, "Proxy: unsolicited %d\n", v.cmd)
+			}
+		}
+	}
+}
+
+func proxy_client(conn SerDev, name string, reqs chan ProxyRequest) {
+	fmt.Fprintf(os.Stderr, "Proxy: client %s connected\n", name)
+	c := &MSPSerial{sd: conn, client: true, c0: make(chan MsgData)}
+	go c.Read_msp(c.c0)
+	reply := make(chan MsgData, 1)
+	for v := range c.c0 {
+		reqs <- ProxyRequest{cmd: v.cmd, raw: v.raw, reply: reply}
+		r := <-reply
+		if r.raw != nil {
+			if _, err := conn.Write(r.raw); err != nil {
+				break
+			}
+		}
+	}
+	conn.Close()
+	for range c.c0 {
+	}
+	fmt.Fprintf(os.Stderr, "Proxy: client %s disconnected\n", name)
+}
+
+func listen_addr(s string) string {
+	s = strings.TrimPrefix(s, "tcp://")
+	if !strings.Contains(s, ":") {
+		s = ":" + s
+	}
+	return s
+}
+
+// proxy -listen tcp://[host]:port
+func do_proxy(laddr string) {
+	if laddr == "" {
+		log.Println("proxy: -listen tcp://[host]:port required")
+		os.Exit(EXIT_USAGE)
+	}
+	devdesc := check_device()
+	open_capture()
+
+	ln, err := net.Listen("tcp", listen_addr(laddr))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Proxy: listening on %s\n", ln.Addr())
+	reqs := make(chan ProxyRequest)
+	go run_proxy(devdesc, reqs)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go proxy_client(conn, conn.RemoteAddr().String(), reqs)
+	}
+}
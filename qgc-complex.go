@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+import (
+	"geo"
+)
+
+type qgc_item struct {
+	Typ          string    `json:"type"`
+	Altitude     int       `json:"Altitude"`
+	Altitudemode int       `json:"AltitudeMode"`
+	Command      int       `json:"command"`
+	Jumpid       int       `json:"doJumpId"`
+	Frame        int       `json:"frame"`
+	Params       []float64 `json:"params"`
+}
+
+// A plan item; the complex item fields are those used by impload
+type qgc_complex struct {
+	qgc_item
+	Complextype string `json:"complexItemType"`
+	Transect    struct {
+		Items []qgc_item `json:"items"`
+	} `json:"TransectStyleComplexItem,omitempty"`
+	// StructureScan
+	Polygon          [][]float64 `json:"polygon"`
+	Layers           int         `json:"Layers"`
+	StructureHeight  float64     `json:"StructureHeight"`
+	ScanBottomAlt    float64     `json:"ScanBottomAlt"`
+	EntranceAltitude float64     `json:"EntranceAltitude"`
+	StartFromTop     bool        `json:"StartFromTop"`
+	CameraCalc       struct {
+		DistanceToSurface         float64 `json:"DistanceToSurface"`
+		DistanceToSurfaceRelative bool    `json:"DistanceToSurfaceRelative"`
+		AdjustedFootprintFrontal  float64 `json:"AdjustedFootprintFrontal"`
+	} `json:"CameraCalc"`
+	// FixedWingLandingPattern
+	LandCoordinate     []float64 `json:"landCoordinate"`
+	ApproachCoordinate []float64 `json:"landingApproachCoordinate"`
+	LoiterCoordinate   []float64 `json:"loiterCoordinate"` // version 1
+	LoiterClockwise    bool      `json:"loiterClockwise"`
+	AltitudesRelative  bool      `json:"altitudesAreRelative"`
+}
+
+func qgc_altmode(relative bool) int {
+	if relative {
+		return 1
+	}
+	return 2 // AMSL
+}
+
+// A simple item (with its seven parameters) as a QGCrec
+func qgc_simple_rec(qi qgc_item, altmode int) (QGCrec, bool) {
+	if len(qi.Params) != 7 {
+		return QGCrec{}, false
+	}
+	qg := QGCrec{jindex: qi.Jumpid, altmode: altmode, command: qi.Command}
+	qg.lat = qi.Params[4]
+	qg.lon = qi.Params[5]
+	qg.alt = qi.Params[6]
+	for j := 0; j < 4; j++ {
+		qg.params[j] = qi.Params[j]
+	}
+	return qg, true
+}
+
+// Offsets a polygon (as [lat, lon] vertices) outwards by dist metres
+func offset_polygon(poly [][]float64, dist float64) [][2]float64 {
+	n := len(poly)
+	lat0, lon0 := poly[0][0], poly[0][1]
+	kx := math.Cos(lat0*math.Pi/180.0) * 60 * 1852
+	ky := 60 * 1852.0
+	xs := make([]float64, n)
+	ys := make([]float64, n)
+	area := 0.0
+	for j := range poly {
+		xs[j] = (poly[j][1] - lon0) * kx
+		ys[j] = (poly[j][0] - lat0) * ky
+	}
+	for j := range poly {
+		k := (j + 1) % n
+		area += xs[j]*ys[k] - xs[k]*ys[j]
+	}
+	if area < 0 { // clockwise, outside is to the left
+		dist = -dist
+	}
+	normal := func(j, k int) (float64, float64) {
+		dx, dy := xs[k]-xs[j], ys[k]-ys[j]
+		l := math.Hypot(dx, dy)
+		if l == 0 {
+			return 0, 0
+		}
+		return dy / l, -dx / l
+	}
+	pts := make([][2]float64, n)
+	for j := range poly {
+		nx1, ny1 := normal((j+n-1)%n, j)
+		nx2, ny2 := normal(j, (j+1)%n)
+		// mitre join, unless the edges double back
+		d := 1 + nx1*nx2 + ny1*ny2
+		var ox, oy float64
+		if d < 0.1 {
+			ox, oy = nx1*dist, ny1*dist
+		} else {
+			ox, oy = (nx1+nx2)*dist/d, (ny1+ny2)*dist/d
+		}
+		pts[j] = [2]float64{lat0 + (ys[j]+oy)/ky, lon0 + (xs[j]+ox)/kx}
+	}
+	return pts
+}
+
+// QGC does not store the generated items of a structure scan. Each layer is
+// flown around the structure polygon, at the camera distance, closing the
+// loop; layers are evenly spaced between the scan bottom and the structure
+// height. The entrance altitude, if set, is used to enter and leave the scan.
+func qgc_structure_scan(ci *qgc_complex) []QGCrec {
+	if len(ci.Polygon) < 3 {
+		fmt.Fprintln(os.Stderr, "QGC: StructureScan without polygon dropped")
+		return nil
+	}
+	for _, v := range ci.Polygon {
+		if len(v) < 2 {
+			fmt.Fprintln(os.Stderr, "QGC: StructureScan with invalid polygon dropped")
+			return nil
+		}
+	}
+	surface := ci.StructureHeight - ci.ScanBottomAlt
+	if surface < 0 {
+		surface = 0
+	}
+	layers := ci.Layers
+	if layers < 1 {
+		layers = 1
+		if ci.CameraCalc.AdjustedFootprintFrontal > 0 {
+			layers = int(math.Ceil(surface / ci.CameraCalc.AdjustedFootprintFrontal))
+		}
+		if layers < 1 {
+			layers = 1
+		}
+	}
+	lheight := surface / float64(layers)
+	altmode := qgc_altmode(ci.CameraCalc.DistanceToSurfaceRelative)
+	pts := offset_polygon(ci.Polygon, ci.CameraCalc.DistanceToSurface)
+	wp := func(p [2]float64, alt float64) QGCrec {
+		return QGCrec{command: mavcmd_NAV_WAYPOINT, altmode: altmode, lat: p[0], lon: p[1], alt: math.Round(alt)}
+	}
+	qs := []QGCrec{}
+	if ci.EntranceAltitude > 0 {
+		qs = append(qs, wp(pts[0], ci.EntranceAltitude))
+	}
+	for l := 0; l < layers; l++ {
+		k := l
+		if ci.StartFromTop {
+			k = layers - l - 1
+		}
+		alt := ci.ScanBottomAlt + lheight*(float64(k)+0.5)
+		for _, p := range pts {
+			qs = append(qs, wp(p, alt))
+		}
+		qs = append(qs, wp(pts[0], alt))
+	}
+	if ci.EntranceAltitude > 0 {
+		qs = append(qs, wp(pts[0], ci.EntranceAltitude))
+	}
+	fmt.Fprintf(os.Stderr, "QGC: StructureScan of %d layers, %d WPs (camera triggers dropped)\n", layers, len(qs))
+	return qs
+}
+
+// A fixed wing landing pattern is a LAND at the landing point, with an inav
+// FW approach from the approach (loiter) point direction. The heading is
+// exclusive, the pattern being planned for a single direction.
+func qgc_fw_landing(ci *qgc_complex) []QGCrec {
+	app := ci.ApproachCoordinate
+	if len(app) < 3 {
+		app = ci.LoiterCoordinate
+	}
+	lnd := ci.LandCoordinate
+	if len(app) < 3 || len(lnd) < 3 {
+		fmt.Fprintln(os.Stderr, "QGC: FixedWingLandingPattern without coordinates dropped")
+		return nil
+	}
+	cse, _ := geo.Csedist(app[0], app[1], lnd[0], lnd[1])
+	hdg := int16(math.Round(cse))
+	if hdg == 0 {
+		hdg = 360
+	}
+	fwa := &FWApproach{No: 8, Appalt: int32(app[2] * 100), Landalt: int32(lnd[2] * 100),
+		Dirn1: -hdg, Dref: "left", Aref: !ci.AltitudesRelative}
+	if ci.LoiterClockwise {
+		fwa.Dref = "right"
+	}
+	fmt.Fprintf(os.Stderr, "QGC: FixedWingLandingPattern as LAND with FW approach, heading %d, approach %.0fm, land %.0fm\n", hdg, app[2], lnd[2])
+	return []QGCrec{{command: mavcmd_NAV_LAND, altmode: qgc_altmode(ci.AltitudesRelative),
+		lat: lnd[0], lon: lnd[1], alt: lnd[2], fwa: fwa}}
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+import (
+	"geo"
+)
+
+// Offline rendering of missions (-fmt svg, png). Each segment is drawn in a
+// local (equirectangular) projection, at the scale of the map zoom mwp would
+// use (evince_zoom) unless that would not fit, with an altitude profile
+// below. Only the mission geometry is drawn; there is no map background.
+
+const (
+	render_WIDTH   = 800 // map panel width (px)
+	render_MAXH    = 700 // map panel height limit
+	render_MINH    = 240
+	render_MARGIN  = 20
+	render_PAD     = 64 // between the mission and the map panel edge (and arrows)
+	render_TITLE   = 32
+	render_PROFILE = 160 // altitude profile panel height
+	render_GAP     = 16
+)
+
+var render_colours = map[string]string{
+	"WAYPOINT":      "#1f77b4",
+	"POSHOLD_UNLIM": "#ff7f0e",
+	"POSHOLD_TIME":  "#e6a700",
+	"LAND":          "#d62728",
+	"SET_POI":       "#9467bd",
+	"JUMP":          "#2ca02c",
+	"RTH":           "#7f7f7f",
+	"SET_HEAD":      "#8c564b",
+}
+
+func render_colour(action string) string {
+	if c, ok := render_colours[action]; ok {
+		return c
+	}
+	return "#000000"
+}
+
+// The drawing primitives used by the renderer; colours are "#rrggbb" (or
+// "none"), text is anchored "start", "middle" or "end" at its baseline
+type canvas interface {
+	line(pts [][2]float64, col string, width float64, dashed bool)
+	polygon(pts [][2]float64, fill string)
+	circle(x, y, r float64, fill, stroke string)
+	rect(x, y, w, h float64, fill, stroke string)
+	text(x, y, size float64, col, anchor, s string)
+}
+
+// Placement and projection of a segment
+type seg_layout struct {
+	ms         *MissionSegment
+	segno      int
+	lat0, lon0 float64
+	kx, ky     float64 // metres per degree
+	scale      float64 // pixels per metre
+	top        float64
+	mh         float64 // map panel height
+	ngeo       int
+}
+
+// A WP flown to; SET_POI is geographic, but not on the path
+func is_flown(mi *MissionItem) bool {
+	return mi.is_GeoPoint() && mi.Action != "SET_POI"
+}
+
+func has_home(ms *MissionSegment) bool {
+	return ms.Metadata.Homey != 0 || ms.Metadata.Homex != 0
+}
+
+func segment_layout(ms *MissionSegment, segno int, top float64) *seg_layout {
+	l := &seg_layout{ms: ms, segno: segno, top: top, scale: 1, mh: render_MINH}
+	bbox := BBox{-999, 999, -999, 999}
+	add := func(lat, lon float64) {
+		bbox.lamax = math.Max(bbox.lamax, lat)
+		bbox.lamin = math.Min(bbox.lamin, lat)
+		bbox.lomax = math.Max(bbox.lomax, lon)
+		bbox.lomin = math.Min(bbox.lomin, lon)
+	}
+	for k := range ms.MissionItems {
+		if mi := &ms.MissionItems[k]; mi.is_GeoPoint() {
+			add(mi.Lat, mi.Lon)
+			l.ngeo++
+		}
+	}
+	if l.ngeo == 0 {
+		return l
+	}
+	if has_home(ms) {
+		add(ms.Metadata.Homey, ms.Metadata.Homex)
+	}
+	l.lat0 = (bbox.lamax + bbox.lamin) / 2
+	l.lon0 = (bbox.lomax + bbox.lomin) / 2
+	l.ky = 60 * 1852.0
+	l.kx = math.Cos(l.lat0*math.Pi/180.0) * 60 * 1852
+	ew := (bbox.lomax - bbox.lomin) * l.kx
+	eh := (bbox.lamax - bbox.lamin) * l.ky
+	l.scale = math.Inf(1)
+	if z := evince_zoom(bbox); z > 0 { // web mercator resolution at zoom z
+		l.scale = math.Exp2(float64(z)) / (156543.03392 * math.Cos(l.lat0*math.Pi/180.0))
+	}
+	if ew > 0 {
+		l.scale = math.Min(l.scale, (render_WIDTH-2*render_PAD)/ew)
+	}
+	if eh > 0 {
+		l.scale = math.Min(l.scale, (render_MAXH-2*render_PAD)/eh)
+	}
+	l.mh = math.Max(eh*l.scale+2*render_PAD, render_MINH)
+	return l
+}
+
+func (l *seg_layout) height() float64 {
+	return render_TITLE + l.mh + render_GAP + render_PROFILE + 2*render_GAP
+}
+
+// Map position (px) of lat, lon
+func (l *seg_layout) xy(lat, lon float64) [2]float64 {
+	x := render_MARGIN + render_WIDTH/2 + (lon-l.lon0)*l.kx*l.scale
+	y := l.top + render_TITLE + l.mh/2 - (lat-l.lat0)*l.ky*l.scale
+	return [2]float64{x, y}
+}
+
+func (mm *MultiMission) render_layout() ([]*seg_layout, int, int) {
+	mm.Update_mission_meta(given_rebase())
+	ls := []*seg_layout{}
+	top := float64(render_MARGIN)
+	for j := range mm.Segment {
+		l := segment_layout(&mm.Segment[j], j+1, top)
+		top += l.height()
+		ls = append(ls, l)
+	}
+	return ls, render_WIDTH + 2*render_MARGIN, int(math.Ceil(top + render_MARGIN - 2*render_GAP))
+}
+
+func (mm *MultiMission) render(c canvas, ls []*seg_layout) {
+	for _, l := range ls {
+		l.draw_map(c)
+		l.draw_profile(c)
+	}
+}
+
+// A 1, 2, 5 x 10^n length (m) of about a fifth of the map
+func scale_length(scale float64) float64 {
+	want := render_WIDTH / 5 / scale
+	p := math.Pow(10, math.Floor(math.Log10(want)))
+	for _, f := range []float64{5, 2, 1} {
+		if f*p <= want {
+			return f * p
+		}
+	}
+	return p
+}
+
+func format_length(m float64) string {
+	if m >= 1000 {
+		return strconv.FormatFloat(m/1000, 'f', -1, 64) + " km"
+	}
+	return strconv.FormatFloat(m, 'f', -1, 64) + " m"
+}
+
+// Quadratic curve from a to b, bulging to the left by a third of the length
+func jump_arc(a, b [2]float64) [][2]float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	cx := (a[0]+b[0])/2 + dy/3
+	cy := (a[1]+b[1])/2 - dx/3
+	if dx == 0 && dy == 0 { // jump to itself, a loop
+		cx, cy = a[0]+30, a[1]-30
+	}
+	pts := [][2]float64{}
+	for k := 0; k <= 24; k++ {
+		t := float64(k) / 24
+		u := 1 - t
+		pts = append(pts, [2]float64{u*u*a[0] + 2*u*t*cx + t*t*b[0], u*u*a[1] + 2*u*t*cy + t*t*b[1]})
+	}
+	return pts
+}
+
+// Approach headings (deg); a positive heading may be flown either way
+func approach_headings(f FWApproach) []float64 {
+	hs := []float64{}
+	for _, d := range []int16{f.Dirn1, f.Dirn2} {
+		if d == 0 {
+			continue
+		}
+		h := math.Abs(float64(d))
+		hs = append(hs, h)
+		if d > 0 {
+			hs = append(hs, h+180)
+		}
+	}
+	return hs
+}
+
+func (l *seg_layout) draw_map(c canvas) {
+	ms := l.ms
+	x0 := float64(render_MARGIN)
+	y0 := l.top + render_TITLE
+	c.text(x0, y0-10, 14, "#000000", "start", fmt.Sprintf("Segment %d: %d WPs", l.segno, len(ms.MissionItems)))
+	c.rect(x0, y0, render_WIDTH, l.mh, "#f7f7f2", "#999999")
+	if l.ngeo == 0 {
+		c.text(x0+render_WIDTH/2, y0+l.mh/2, 12, "#666666", "middle", "No geographic WPs")
+		return
+	}
+	home := has_home(ms)
+	var hp [2]float64
+	if home {
+		hp = l.xy(ms.Metadata.Homey, ms.Metadata.Homex)
+	}
+	pos := make([][2]float64, len(ms.MissionItems))
+	for k := range ms.MissionItems {
+		pos[k] = l.xy(ms.MissionItems[k].Lat, ms.MissionItems[k].Lon)
+	}
+
+	// legs, JUMP arcs and RTH
+	actions := []string{}
+	seen := map[string]bool{}
+	legend := func(a string) {
+		if !seen[a] {
+			seen[a] = true
+			actions = append(actions, a)
+		}
+	}
+	last := -1
+	for k := range ms.MissionItems {
+		mi := &ms.MissionItems[k]
+		switch {
+		case is_flown(mi):
+			if last == -1 && home {
+				c.line([][2]float64{hp, pos[k]}, "#7f7f7f", 1.5, true)
+			} else if last != -1 {
+				c.line([][2]float64{pos[last], pos[k]}, "#444444", 2, false)
+			}
+			last = k
+		case mi.Action == "JUMP":
+			t := int(mi.P1) - 1
+			if last == -1 || t < 0 || t >= len(ms.MissionItems) || !is_flown(&ms.MissionItems[t]) {
+				continue
+			}
+			legend("JUMP")
+			arc := jump_arc(pos[last], pos[t])
+			c.line(arc, render_colour("JUMP"), 1.5, true)
+			rep := "x" + strconv.Itoa(int(mi.P2))
+			if mi.P2 == -1 {
+				rep = "x∞"
+			}
+			mid := arc[len(arc)/2]
+			c.text(mid[0], mid[1]-4, 11, render_colour("JUMP"), "middle", rep)
+		case mi.Action == "RTH":
+			if last != -1 && home {
+				legend("RTH")
+				c.line([][2]float64{pos[last], hp}, render_colour("RTH"), 1.5, true)
+			}
+		}
+	}
+
+	// FW approach arrows, into the LAND WPs
+	if has_fwapproach(ms.FWApproach) {
+		for k := range ms.MissionItems {
+			if ms.MissionItems[k].Action != "LAND" {
+				continue
+			}
+			for _, h := range approach_headings(ms.FWApproach) {
+				sx, sy := math.Sin(h*math.Pi/180), -math.Cos(h*math.Pi/180)
+				p := pos[k]
+				tip := [2]float64{p[0] - 12*sx, p[1] - 12*sy}
+				tail := [2]float64{p[0] - 56*sx, p[1] - 56*sy}
+				c.line([][2]float64{tail, tip}, "#c03060", 2.5, false)
+				c.polygon([][2]float64{tip,
+					{tip[0] - 10*sx - 5*sy, tip[1] - 10*sy + 5*sx},
+					{tip[0] - 10*sx + 5*sy, tip[1] - 10*sy - 5*sx}}, "#c03060")
+			}
+		}
+	}
+
+	if home {
+		c.rect(hp[0]-9, hp[1]-9, 18, 18, "#2ca02c", "#ffffff")
+		c.text(hp[0], hp[1]+4, 11, "#ffffff", "middle", "H")
+	}
+	for k := range ms.MissionItems {
+		mi := &ms.MissionItems[k]
+		if !mi.is_GeoPoint() {
+			continue
+		}
+		legend(mi.Action)
+		if mi.Action == "SET_POI" {
+			p := pos[k]
+			c.polygon([][2]float64{{p[0], p[1] - 11}, {p[0] + 11, p[1]}, {p[0], p[1] + 11}, {p[0] - 11, p[1]}}, render_colour(mi.Action))
+			c.text(p[0], p[1]+3.5, 10, "#ffffff", "middle", strconv.Itoa(mi.No))
+			continue
+		}
+		c.circle(pos[k][0], pos[k][1], 9, render_colour(mi.Action), "#ffffff")
+		c.text(pos[k][0], pos[k][1]+3.5, 10, "#ffffff", "middle", strconv.Itoa(mi.No))
+	}
+
+	// legend (actions drawn, in mission order), scale bar
+	actions = actions[:0]
+	for k := range ms.MissionItems {
+		if a := ms.MissionItems[k].Action; seen[a] {
+			seen[a] = false
+			actions = append(actions, a)
+		}
+	}
+	for j, a := range actions {
+		y := y0 + 16 + float64(j)*16
+		c.circle(x0+render_WIDTH-110, y-4, 5, render_colour(a), "none")
+		c.text(x0+render_WIDTH-100, y, 10, "#333333", "start", a)
+	}
+	sl := scale_length(l.scale)
+	sx, sy := x0+16, y0+l.mh-16
+	sw := sl * l.scale
+	c.line([][2]float64{{sx, sy - 5}, {sx, sy}, {sx + sw, sy}, {sx + sw, sy - 5}}, "#000000", 1.5, false)
+	c.text(sx+sw/2, sy-6, 11, "#000000", "middle", format_length(sl))
+}
+
+// Altitude against the distance along the legs (JUMPs are not followed)
+func (l *seg_layout) draw_profile(c canvas) {
+	ms := l.ms
+	x0 := float64(render_MARGIN)
+	y0 := l.top + render_TITLE + l.mh + render_GAP
+	c.rect(x0, y0, render_WIDTH, render_PROFILE, "#ffffff", "#999999")
+	if l.ngeo == 0 {
+		return
+	}
+	type ppt struct {
+		d   float64
+		mi  *MissionItem
+		pos [2]float64
+	}
+	pts := []ppt{}
+	var last *MissionItem
+	d := 0.0
+	amin, amax := 0.0, 0.0
+	amsl := false
+	for k := range ms.MissionItems {
+		mi := &ms.MissionItems[k]
+		if !is_flown(mi) {
+			continue
+		}
+		if last != nil {
+			_, nm := geo.Csedist(last.Lat, last.Lon, mi.Lat, mi.Lon)
+			d += nm * 1852.0
+		}
+		last = mi
+		amin = math.Min(amin, float64(mi.Alt))
+		amax = math.Max(amax, float64(mi.Alt))
+		if mi.P3&1 == 1 {
+			amsl = true
+		}
+		pts = append(pts, ppt{d: d, mi: mi})
+	}
+	if len(pts) == 0 {
+		return
+	}
+	if amax == amin {
+		amax = amin + 10
+	}
+	if d == 0 {
+		d = 1
+	}
+	left, right, top, bottom := x0+56, x0+render_WIDTH-24, y0+30, y0+render_PROFILE-24
+	for j := range pts {
+		pts[j].pos = [2]float64{left + (right-left)*pts[j].d/d,
+			bottom - (bottom-top)*(float64(pts[j].mi.Alt)-amin)/(amax-amin)}
+	}
+	c.line([][2]float64{{left, top}, {left, bottom}, {right, bottom}}, "#999999", 1, false)
+	c.text(left-6, top+4, 10, "#333333", "end", fmt.Sprintf("%.0f m", amax))
+	c.text(left-6, bottom+4, 10, "#333333", "end", fmt.Sprintf("%.0f m", amin))
+	c.text(right, bottom+16, 10, "#333333", "end", format_length(math.Round(pts[len(pts)-1].d)))
+	label := "Altitude"
+	if amsl {
+		label = "Altitude (includes AMSL WPs)"
+	}
+	c.text(x0+8, y0+14, 10, "#333333", "start", label)
+	line := [][2]float64{}
+	for _, p := range pts {
+		line = append(line, p.pos)
+	}
+	c.line(line, "#444444", 1.5, false)
+	for _, p := range pts {
+		c.circle(p.pos[0], p.pos[1], 4, render_colour(p.mi.Action), "none")
+		c.text(p.pos[0], p.pos[1]-7, 9, "#333333", "middle", strconv.Itoa(p.mi.No))
+	}
+}
+
+type svg_canvas struct {
+	w io.Writer
+}
+
+var svg_escape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+func svg_points(pts [][2]float64) string {
+	ps := make([]string, len(pts))
+	for j, p := range pts {
+		ps[j] = fmt.Sprintf("%.1f,%.1f", p[0], p[1])
+	}
+	return strings.Join(ps, " ")
+}
+
+func (s *svg_canvas) line(pts [][2]float64, col string, width float64, dashed bool) {
+	dash := ""
+	if dashed {
+		dash = ` stroke-dasharray="6 4"`
+	}
+	fmt.Fprintf(s.w, "<polyline points=\"%s\" fill=\"none\" stroke=\"%s\" stroke-width=\"%.1f\" stroke-linecap=\"round\" stroke-linejoin=\"round\"%s/>\n",
+		svg_points(pts), col, width, dash)
+}
+
+func (s *svg_canvas) polygon(pts [][2]float64, fill string) {
+	fmt.Fprintf(s.w, "<polygon points=\"%s\" fill=\"%s\"/>\n", svg_points(pts), fill)
+}
+
+func (s *svg_canvas) circle(x, y, r float64, fill, stroke string) {
+	fmt.Fprintf(s.w, "<circle cx=\"%.1f\" cy=\"%.1f\" r=\"%.1f\" fill=\"%s\" stroke=\"%s\" stroke-width=\"1.5\"/>\n", x, y, r, fill, stroke)
+}
+
+func (s *svg_canvas) rect(x, y, w, h float64, fill, stroke string) {
+	fmt.Fprintf(s.w, "<rect x=\"%.1f\" y=\"%.1f\" width=\"%.1f\" height=\"%.1f\" fill=\"%s\" stroke=\"%s\"/>\n", x, y, w, h, fill, stroke)
+}
+
+func (s *svg_canvas) text(x, y, size float64, col, anchor, str string) {
+	fmt.Fprintf(s.w, "<text x=\"%.1f\" y=\"%.1f\" font-size=\"%.0f\" fill=\"%s\" text-anchor=\"%s\">%s</text>\n",
+		x, y, size, col, anchor, svg_escape.Replace(str))
+}
+
+func (mm *MultiMission) To_svg(w io.Writer) {
+	ls, width, height := mm.render_layout()
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\" font-family=\"sans-serif\">\n",
+		width, height, width, height)
+	fmt.Fprintf(w, "<rect width=\"100%%\" height=\"100%%\" fill=\"#ffffff\"/>\n")
+	mm.render(&svg_canvas{w}, ls)
+	fmt.Fprintln(w, "</svg>")
+}
+
+// A simple (not anti-aliased) rasteriser, with a 5x7 bitmap font (characters
+// without a glyph are blank)
+type png_canvas struct {
+	img *image.RGBA
+}
+
+var png_font = map[rune][7]byte{
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e}, '1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f}, '3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02}, '5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e}, '7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e}, '9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	'A': {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11}, 'B': {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e},
+	'C': {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e}, 'D': {0x1c, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1c},
+	'E': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f}, 'F': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'G': {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f}, 'H': {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'I': {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e}, 'J': {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11}, 'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M': {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11}, 'N': {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O': {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e}, 'P': {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10},
+	'Q': {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d}, 'R': {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S': {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e}, 'T': {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U': {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e}, 'V': {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'W': {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a}, 'X': {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11},
+	'Y': {0x11, 0x11, 0x11, 0x0a, 0x04, 0x04, 0x04}, 'Z': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f},
+	'a': {0x00, 0x00, 0x0e, 0x01, 0x0f, 0x11, 0x0f}, 'b': {0x10, 0x10, 0x16, 0x19, 0x11, 0x11, 0x1e},
+	'c': {0x00, 0x00, 0x0e, 0x10, 0x10, 0x11, 0x0e}, 'd': {0x01, 0x01, 0x0d, 0x13, 0x11, 0x11, 0x0f},
+	'e': {0x00, 0x00, 0x0e, 0x11, 0x1f, 0x10, 0x0e}, 'f': {0x06, 0x09, 0x08, 0x1c, 0x08, 0x08, 0x08},
+	'g': {0x00, 0x0f, 0x11, 0x11, 0x0f, 0x01, 0x0e}, 'h': {0x10, 0x10, 0x16, 0x19, 0x11, 0x11, 0x11},
+	'i': {0x04, 0x00, 0x0c, 0x04, 0x04, 0x04, 0x0e}, 'j': {0x02, 0x00, 0x06, 0x02, 0x02, 0x12, 0x0c},
+	'k': {0x10, 0x10, 0x12, 0x14, 0x18, 0x14, 0x12}, 'l': {0x0c, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'm': {0x00, 0x00, 0x1a, 0x15, 0x15, 0x11, 0x11}, 'n': {0x00, 0x00, 0x16, 0x19, 0x11, 0x11, 0x11},
+	'o': {0x00, 0x00, 0x0e, 0x11, 0x11, 0x11, 0x0e}, 'p': {0x00, 0x00, 0x1e, 0x11, 0x1e, 0x10, 0x10},
+	'q': {0x00, 0x00, 0x0d, 0x13, 0x0f, 0x01, 0x01}, 'r': {0x00, 0x00, 0x16, 0x19, 0x10, 0x10, 0x10},
+	's': {0x00, 0x00, 0x0e, 0x10, 0x0e, 0x01, 0x1e}, 't': {0x08, 0x08, 0x1c, 0x08, 0x08, 0x09, 0x06},
+	'u': {0x00, 0x00, 0x11, 0x11, 0x11, 0x13, 0x0d}, 'v': {0x00, 0x00, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'w': {0x00, 0x00, 0x11, 0x11, 0x15, 0x15, 0x0a}, 'x': {0x00, 0x00, 0x11, 0x0a, 0x04, 0x0a, 0x11},
+	'y': {0x00, 0x00, 0x11, 0x11, 0x0f, 0x01, 0x0e}, 'z': {0x00, 0x00, 0x1f, 0x02, 0x04, 0x08, 0x1f},
+	'∞': {0x00, 0x00, 0x0a, 0x15, 0x0a, 0x00, 0x00},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c}, ',': {0x00, 0x00, 0x00, 0x00, 0x0c, 0x04, 0x08},
+	':': {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00}, '-': {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	'/': {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00}, '_': {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f},
+	'(': {0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02}, ')': {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08},
+	' ': {},
+}
+
+func png_colour(col string) (color.RGBA, bool) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(col, "#"), 16, 32)
+	if err != nil || !strings.HasPrefix(col, "#") {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, true
+}
+
+func (p *png_canvas) disc(x, y, r float64, c color.RGBA) {
+	if r < 0.75 {
+		p.img.SetRGBA(int(math.Round(x)), int(math.Round(y)), c)
+		return
+	}
+	for iy := int(math.Floor(y - r)); iy <= int(math.Ceil(y+r)); iy++ {
+		for ix := int(math.Floor(x - r)); ix <= int(math.Ceil(x+r)); ix++ {
+			if dx, dy := float64(ix)-x, float64(iy)-y; dx*dx+dy*dy <= r*r {
+				p.img.SetRGBA(ix, iy, c)
+			}
+		}
+	}
+}
+
+func (p *png_canvas) line(pts [][2]float64, col string, width float64, dashed bool) {
+	c, ok := png_colour(col)
+	if !ok {
+		return
+	}
+	run := 0.0 // along the line, for the 6 on, 4 off dashes
+	for j := 1; j < len(pts); j++ {
+		a, b := pts[j-1], pts[j]
+		l := math.Hypot(b[0]-a[0], b[1]-a[1])
+		n := int(math.Ceil(l*2)) + 1
+		for k := 0; k <= n; k++ {
+			t := float64(k) / float64(n)
+			if dashed && math.Mod(run+t*l, 10) >= 6 {
+				continue
+			}
+			p.disc(a[0]+t*(b[0]-a[0]), a[1]+t*(b[1]-a[1]), width/2, c)
+		}
+		run += l
+	}
+}
+
+// Even-odd scanline fill
+func (p *png_canvas) polygon(pts [][2]float64, fill string) {
+	c, ok := png_colour(fill)
+	if !ok || len(pts) < 3 {
+		return
+	}
+	ymin, ymax := pts[0][1], pts[0][1]
+	for _, pt := range pts {
+		ymin = math.Min(ymin, pt[1])
+		ymax = math.Max(ymax, pt[1])
+	}
+	for iy := int(math.Floor(ymin)); iy <= int(math.Ceil(ymax)); iy++ {
+		y := float64(iy) + 0.5
+		xs := []float64{}
+		for j := range pts {
+			a, b := pts[j], pts[(j+1)%len(pts)]
+			if (a[1] <= y) != (b[1] <= y) {
+				xs = append(xs, a[0]+(y-a[1])*(b[0]-a[0])/(b[1]-a[1]))
+			}
+		}
+		for j := 0; j+1 < len(xs); j += 2 {
+			x1, x2 := math.Min(xs[j], xs[j+1]), math.Max(xs[j], xs[j+1])
+			for ix := int(math.Round(x1)); ix <= int(math.Round(x2)); ix++ {
+				p.img.SetRGBA(ix, iy, c)
+			}
+		}
+	}
+}
+
+func (p *png_canvas) circle(x, y, r float64, fill, stroke string) {
+	if c, ok := png_colour(stroke); ok {
+		p.disc(x, y, r+1, c)
+	}
+	if c, ok := png_colour(fill); ok {
+		p.disc(x, y, r, c)
+	}
+}
+
+func (p *png_canvas) rect(x, y, w, h float64, fill, stroke string) {
+	if c, ok := png_colour(fill); ok {
+		for iy := int(y); iy < int(y+h); iy++ {
+			for ix := int(x); ix < int(x+w); ix++ {
+				p.img.SetRGBA(ix, iy, c)
+			}
+		}
+	}
+	p.line([][2]float64{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}, {x, y}}, stroke, 1, false)
+}
+
+func (p *png_canvas) text(x, y, size float64, col, anchor, str string) {
+	c, ok := png_colour(col)
+	if !ok {
+		return
+	}
+	sc := 1
+	if size >= 13 {
+		sc = 2
+	}
+	rs := []rune(str)
+	w := float64(len(rs)*6*sc - sc)
+	switch anchor {
+	case "middle":
+		x -= w / 2
+	case "end":
+		x -= w
+	}
+	ix, iy := int(math.Round(x)), int(math.Round(y))-7*sc
+	for _, r := range rs {
+		g := png_font[r]
+		for row := 0; row < 7; row++ {
+			for bit := 0; bit < 5; bit++ {
+				if g[row]&(0x10>>bit) == 0 {
+					continue
+				}
+				for dy := 0; dy < sc; dy++ {
+					for dx := 0; dx < sc; dx++ {
+						p.img.SetRGBA(ix+bit*sc+dx, iy+row*sc+dy, c)
+					}
+				}
+			}
+		}
+		ix += 6 * sc
+	}
+}
+
+func (mm *MultiMission) To_png(w io.Writer) {
+	ls, width, height := mm.render_layout()
+	p := &png_canvas{image.NewRGBA(image.Rect(0, 0, width, height))}
+	p.rect(0, 0, float64(width), float64(height), "#ffffff", "none")
+	mm.render(p, ls)
+	png.Encode(w, p.img)
+}
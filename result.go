@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Exit codes
+const (
+	EXIT_OK    = 0 // success
+	EXIT_FAIL  = 1 // operation failed (e.g. upload rejected, verify or diff found differences)
+	EXIT_USAGE = 2 // invalid command, options or input file
+	EXIT_FC    = 3 // FC communication failed (no device, timeout, link lost)
+)
+
+// Result of an FC command, reported on stdout with -json
+type Result struct {
+	Command     string           `json:"command"`
+	Device      string           `json:"device,omitempty"`
+	Ok          bool             `json:"ok"`
+	Error       string           `json:"error,omitempty"`
+	FC          *FCInfo          `json:"fc,omitempty"`
+	File        string           `json:"file,omitempty"`
+	Type        string           `json:"type,omitempty"`
+	Segments    *int             `json:"segments,omitempty"`
+	Waypoints   *int             `json:"waypoints,omitempty"`
+	Saved       bool             `json:"saved,omitempty"`
+	Verified    *bool            `json:"verified,omitempty"`
+	Differences []string         `json:"differences,omitempty"`
+	MultiIndex  *int             `json:"multi_index,omitempty"`
+	Mission     *MultiMission    `json:"mission,omitempty"`
+	Timings     map[string]int64 `json:"timings_ms"`
+	jsonout     bool
+	status      int
+}
+
+func NewResult(cmd string, jsonout bool) *Result {
+	return &Result{Command: cmd, jsonout: jsonout, Timings: map[string]int64{}}
+}
+
+// Runs fn, recording its duration (ms) as the named timing
+func (r *Result) timed(name string, fn func()) {
+	t := time.Now()
+	fn()
+	r.Timings[name] = time.Since(t).Milliseconds()
+}
+
+func (r *Result) fail(status int, format string, a ...interface{}) {
+	r.status = status
+	r.Error = fmt.Sprintf(format, a...)
+}
+
+func (r *Result) set_mission(mm *MultiMission) {
+	nseg := len(mm.Segment)
+	nwp := mm.wp_count()
+	r.Segments = &nseg
+	r.Waypoints = &nwp
+}
+
+// Opens the FC and runs fn, which returns false if the operation failed.
+// FC communication errors end the operation (EXIT_FC).
+func (r *Result) run_fc(fn func(s *MSPSerial) bool) {
+	r.run_link(fn, nil)
+}
+
+// As run_fc, running mav for a MAVLink device; nil if the command is MSP only
+func (r *Result) run_link(fn func(s *MSPSerial) bool, mav func(mv *MAVLink) bool) {
+	devdesc, err := find_device()
+	if err != nil {
+		r.fail(EXIT_FC, "%v", err)
+		return
+	}
+	open_capture()
+	r.run_on(devdesc, nil, fn, mav)
+}
+
+func (r *Result) run_on(devdesc DevDescription, msgs io.Writer, fn func(s *MSPSerial) bool, mav func(mv *MAVLink) bool) {
+	if !devdesc.mavlink {
+		r.run_device(devdesc, msgs, fn)
+	} else if mav != nil {
+		r.run_mavlink(devdesc, msgs, mav)
+	} else {
+		r.fail(EXIT_USAGE, "%s is not supported over MAVLink", r.Command)
+	}
+}
+
+// Ends the operation on an FC communication error (EXIT_FC)
+func (r *Result) recover_fc() {
+	if e := recover(); e != nil {
+		if err, ok := e.(MSPError); ok {
+			r.fail(EXIT_FC, "FC: %v", err)
+		} else {
+			panic(e)
+		}
+	}
+}
+
+// As run_fc, for the given MSP device, with progress messages to msgs
+func (r *Result) run_device(devdesc DevDescription, msgs io.Writer, fn func(s *MSPSerial) bool) {
+	defer r.recover_fc()
+	var s *MSPSerial
+	var err error
+	r.timed("connect", func() {
+		if s, err = NewMSPSerial(devdesc); err == nil {
+			s.recoverable = true
+			s.msgs = msgs
+			s.Init()
+		}
+	})
+	if err != nil {
+		r.fail(EXIT_FC, "%v", err)
+		return
+	}
+	r.FC = &s.info
+	if !fn(s) && r.status == EXIT_OK {
+		r.status = EXIT_FAIL
+	}
+}
+
+// Reports the result (as JSON on stdout with -json, otherwise any error on
+// stderr) and exits
+func (r *Result) exit() {
+	r.Ok = r.status == EXIT_OK
+	if r.jsonout {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+	} else if r.Error != "" {
+		fmt.Fprintln(os.Stderr, r.Error)
+	}
+	capture.Close()
+	os.Exit(r.status)
+}
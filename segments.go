@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// inav supports up to 9 mission segments
+const MAX_SEGMENTS = 9
+
+// Rebuilds WP numbering, the 0xa5 end of segment flags and the FW approach
+// indices after segments have been added, removed or reordered
+func (mm *MultiMission) Renumber_segments() {
+	for j := range mm.Segment {
+		mlen := len(mm.Segment[j].MissionItems)
+		for k := range mm.Segment[j].MissionItems {
+			mm.Segment[j].MissionItems[k].No = k + 1
+			if k == mlen-1 {
+				mm.Segment[j].MissionItems[k].Flag = 0xa5
+			} else if mm.Segment[j].MissionItems[k].Flag == 0xa5 {
+				mm.Segment[j].MissionItems[k].Flag = 0
+			}
+		}
+		// Always set, so the FC's approach for this index is replaced
+		mm.Segment[j].FWApproach.Index = int8(j)
+		mm.Segment[j].FWApproach.No = int8(j + 8)
+	}
+}
+
+func (mm *MultiMission) wp_count() int {
+	n := 0
+	for _, s := range mm.Segment {
+		n += len(s.MissionItems)
+	}
+	return n
+}
+
+func (mm *MultiMission) check_segments(maxwp int) error {
+	if len(mm.Segment) > MAX_SEGMENTS {
+		return fmt.Errorf("too many segments (%d, max %d)", len(mm.Segment), MAX_SEGMENTS)
+	}
+	if n := mm.wp_count(); n > maxwp {
+		return fmt.Errorf("too many waypoints (%d, max %d)", n, maxwp)
+	}
+	if !mm.valid_for(maxwp) {
+		return fmt.Errorf("mission fails verification")
+	}
+	return nil
+}
+
+// Replaces segment n (1 based); n = number of segments + 1 appends
+func (mm *MultiMission) Replace_segment(n int, ms MissionSegment) error {
+	if n < 1 || n > len(mm.Segment)+1 {
+		return fmt.Errorf("invalid segment %d", n)
+	}
+	if n == len(mm.Segment)+1 {
+		mm.Segment = append(mm.Segment, ms)
+	} else {
+		mm.Segment[n-1] = ms
+	}
+	mm.Renumber_segments()
+	return nil
+}
+
+func (mm *MultiMission) Delete_segment(n int) error {
+	if n < 1 || n > len(mm.Segment) {
+		return fmt.Errorf("invalid segment %d", n)
+	}
+	if len(mm.Segment) == 1 {
+		return fmt.Errorf("cannot delete the only segment")
+	}
+	mm.Segment = append(mm.Segment[:n-1], mm.Segment[n:]...)
+	mm.Renumber_segments()
+	return nil
+}
+
+// Moves segment from to position to (both 1 based)
+func (mm *MultiMission) Move_segment(from, to int) error {
+	if from < 1 || from > len(mm.Segment) || to < 1 || to > len(mm.Segment) {
+		return fmt.Errorf("invalid segments %d, %d", from, to)
+	}
+	ms := mm.Segment[from-1]
+	mm.Segment = append(mm.Segment[:from-1], mm.Segment[from:]...)
+	mm.Segment = append(mm.Segment[:to-1], append([]MissionSegment{ms}, mm.Segment[to-1:]...)...)
+	mm.Renumber_segments()
+	return nil
+}
+
+func (mm *MultiMission) List_segments(maxwp int) {
+	for j, ms := range mm.Segment {
+		nwp := len(ms.MissionItems)
+		fmt.Printf("Segment %d: %d WP", j+1, nwp)
+		for _, mi := range ms.MissionItems {
+			if mi.is_GeoPoint() {
+				fmt.Printf(", start %.7f %.7f", mi.Lat, mi.Lon)
+				break
+			}
+		}
+		if nwp > 0 {
+			fmt.Printf(", ends %s", ms.MissionItems[nwp-1].Action)
+		}
+		if ms.FWApproach.Dirn1 != 0 || ms.FWApproach.Dirn2 != 0 {
+			fmt.Printf(", fwapproach %d/%d", ms.FWApproach.Dirn1, ms.FWApproach.Dirn2)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Total %d of %d WP\n", mm.wp_count(), maxwp)
+}
+
+func segment_arg(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		log.Printf("Invalid segment number \"%s\"\n", s)
+		os.Exit(EXIT_USAGE)
+	}
+	return n
+}
+
+// seg list | seg put N FILE | seg del N | seg move FROM TO
+func do_segments(args []string) {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	nargs := map[string]int{"list": 1, "put": 3, "del": 2, "move": 3}
+	if n, ok := nargs[args[0]]; !ok || len(args) != n {
+		log.Println("Usage: seg list | seg put N FILE | seg del N | seg move FROM TO")
+		os.Exit(EXIT_USAGE)
+	}
+
+	devdesc := check_device()
+	s := MSPInit(devdesc)
+	if s.nowp && args[0] != "list" {
+		log.Printf("seg %s: the FC does not support the MSP WP commands; download, edit and upload the mission\n", args[0])
+		os.Exit(EXIT_FC)
+	}
+	mm := s.download(false)
+	if mm.wp_count() == 0 {
+		mm.Segment = []MissionSegment{}
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		mm.List_segments(s.info.WpMax)
+		if !s.nowp { // listed via the CLI, the FC rebooted
+			s.get_multi_index()
+		}
+		return
+	case "put":
+		n := segment_arg(args[1])
+		mtype, m, rerr := Read_Mission_File(args[2])
+		if m == nil || rerr != nil {
+			log.Println("Invalid input file")
+			os.Exit(EXIT_USAGE)
+		}
+		if len(m.Segment) > 1 {
+			fmt.Fprintf(os.Stderr, "Note: using the first of %d segments from %s\n", len(m.Segment), args[2])
+		}
+		sanitise_mission(m, mtype)
+		err = mm.Replace_segment(n, m.Segment[0])
+	case "del":
+		err = mm.Delete_segment(segment_arg(args[1]))
+	case "move":
+		err = mm.Move_segment(segment_arg(args[1]), segment_arg(args[2]))
+	}
+	if err == nil {
+		err = mm.check_segments(s.info.WpMax)
+	}
+	if err != nil {
+		log.Fatalf("seg %s: %v\n", args[0], err)
+	}
+	mm.List_segments(s.info.WpMax)
+	if !s.upload(mm, *save) {
+		os.Exit(EXIT_FAIL)
+	}
+}
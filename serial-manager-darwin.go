@@ -6,18 +6,17 @@ package main
 import (
 	"errors"
 	"go.bug.st/serial"
-	"log"
 )
 
 func enumerate_ports() (string, error) {
 	return "", errors.New("Port name required on MacOS")
 }
 
-func open_serial_port(dd DevDescription) *MSPSerial {
+func open_serial_port(dd DevDescription) (*MSPSerial, error) {
 	p, err := serial.Open(dd.name, &serial.Mode{BaudRate: dd.param})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return &MSPSerial{packet: false, sd: p}
+	return &MSPSerial{packet: false, sd: p}, nil
 
 }
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"github.com/albenik/go-serial/enumerator"
 	"github.com/albenik/go-serial/v2"
-	"log"
 	"os"
 	"runtime"
 )
@@ -38,14 +37,14 @@ func enumerate_ports() (string, error) {
 	return "", err
 }
 
-func open_serial_port(dd DevDescription) *MSPSerial {
+func open_serial_port(dd DevDescription) (*MSPSerial, error) {
 	p, err := serial.Open(dd.name, serial.WithBaudrate(dd.param), serial.WithReadTimeout(1))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	} else {
 		p.SetFirstByteReadTimeout(100)
 		p.ResetInputBuffer()
 		p.ResetOutputBuffer()
 	}
-	return &MSPSerial{packet: false, sd: p}
+	return &MSPSerial{packet: false, sd: p}, nil
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Maximum size of an uploaded mission file
+const SERVE_MAX_BODY = 4 * 1024 * 1024
+
+type Server struct {
+	mu      sync.Mutex
+	s       *MSPSerial
+	origins []string // allowed origins (-origin)
+}
+
+type ServeError struct {
+	Error string `json:"error"`
+}
+
+func write_json(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func write_error(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	write_json(w, status, ServeError{Error: fmt.Sprintf(format, a...)})
+}
+
+// Reads a mission from the request body
+func read_request_mission(w http.ResponseWriter, r *http.Request) (string, *MultiMission, bool) {
+	if r.Method != http.MethodPost {
+		write_error(w, http.StatusMethodNotAllowed, "POST required")
+		return "", nil, false
+	}
+	dat, err := io.ReadAll(io.LimitReader(r.Body, SERVE_MAX_BODY))
+	if err != nil {
+		write_error(w, http.StatusBadRequest, "%v", err)
+		return "", nil, false
+	}
+	mtype, m := handle_mission_data(dat, "request")
+	if m == nil {
+		write_error(w, http.StatusBadRequest, "invalid mission file (%s)", mtype)
+		return mtype, nil, false
+	}
+	return mtype, m, true
+}
+
+func request_format(r *http.Request) string {
+	if f := r.URL.Query().Get("fmt"); f != "" {
+		return f
+	}
+	return "json"
+}
+
+// Mission output; mwp JSON is embedded, other formats are returned as text
+func mission_output(mm *MultiMission, ofmt string, params ...string) map[string]interface{} {
+	res := map[string]interface{}{"format": ofmt, "segments": len(mm.Segment), "waypoints": mm.wp_count()}
+	if ofmt == "json" {
+		mm.Update_mission_meta(given_rebase())
+		res["mission"] = mm
+	} else {
+		var buf bytes.Buffer
+		mm.Write(&buf, ofmt, append([]string{"-"}, params...)...)
+		res["output"] = buf.String()
+	}
+	return res
+}
+
+func (sv *Server) convert(w http.ResponseWriter, r *http.Request) {
+	mtype, m, ok := read_request_mission(w, r)
+	if ok {
+		sanitise_mission(m, mtype)
+		res := mission_output(m, request_format(r), "request", mtype)
+		res["type"] = mtype
+		write_json(w, http.StatusOK, res)
+	}
+}
+
+func (sv *Server) validate(w http.ResponseWriter, r *http.Request) {
+	mtype, m, ok := read_request_mission(w, r)
+	if ok {
+		problems := m.Validate()
+		write_json(w, http.StatusOK, map[string]interface{}{"type": mtype, "valid": len(problems) == 0,
+			"segments": len(m.Segment), "waypoints": m.wp_count(), "problems": problems})
+	}
+}
+
+func (sv *Server) stats(w http.ResponseWriter, r *http.Request) {
+	mtype, m, ok := read_request_mission(w, r)
+	if ok {
+		sanitise_mission(m, mtype)
+		write_json(w, http.StatusOK, map[string]interface{}{"type": mtype, "segments": m.Stats()})
+	}
+}
+
+// Runs fn with the (persistent) FC session, opening it if necessary. A
+// failed session (or one that used the CLI) is closed, to be reopened by the
+// next request.
+func (sv *Server) with_fc(w http.ResponseWriter, fn func(s *MSPSerial) (int, interface{})) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(MSPError); ok {
+				if sv.s != nil {
+					sv.s.sd.Close()
+					sv.s = nil
+				}
+				write_error(w, http.StatusBadGateway, "FC: %v", e)
+			} else {
+				panic(r)
+			}
+		}
+	}()
+	if sv.s == nil {
+		devdesc, err := find_device()
+		var s *MSPSerial
+		if err == nil {
+			s, err = NewMSPSerial(devdesc)
+		}
+		if err != nil {
+			write_error(w, http.StatusBadGateway, "FC: %v", err)
+			return
+		}
+		s.recoverable = true
+		sv.s = s
+		s.Init()
+	}
+	status, res := fn(sv.s)
+	if sv.s.cli.Load() { // the FC rebooted on leaving the CLI
+		sv.s.sd.Close()
+		sv.s = nil
+	}
+	write_json(w, status, res)
+}
+
+func (sv *Server) fc_test(w http.ResponseWriter, r *http.Request) {
+	sv.with_fc(w, func(s *MSPSerial) (int, interface{}) {
+		return http.StatusOK, s.wp_info()
+	})
+}
+
+func (sv *Server) fc_upload(w http.ResponseWriter, r *http.Request, eeprom bool) {
+	mtype, m, ok := read_request_mission(w, r)
+	if ok {
+		sv.with_fc(w, func(s *MSPSerial) (int, interface{}) {
+			if err := s.upload_mission(m, mtype, eeprom); err != nil {
+				return http.StatusUnprocessableEntity, ServeError{Error: err.Error()}
+			}
+			return http.StatusOK, map[string]interface{}{"type": mtype, "saved": eeprom || s.cliwp != nil, "fc": s.wp_info()}
+		})
+	}
+}
+
+func (sv *Server) fc_download(w http.ResponseWriter, r *http.Request, eeprom bool) {
+	sv.with_fc(w, func(s *MSPSerial) (int, interface{}) {
+		mm := s.download(eeprom)
+		return http.StatusOK, mission_output(mm, request_format(r))
+	})
+}
+
+func (sv *Server) fc_multi(w http.ResponseWriter, r *http.Request) {
+	sv.with_fc(w, func(s *MSPSerial) (int, interface{}) {
+		if r.Method == http.MethodPost {
+			idx, err := strconv.Atoi(r.URL.Query().Get("index"))
+			if err != nil || idx < 0 || idx > MAX_SEGMENTS {
+				return http.StatusBadRequest, ServeError{Error: "index (0-9) required"}
+			}
+			if _, err = s.set_setting(SETTING_STR, strconv.Itoa(idx)); err != nil {
+				return http.StatusUnprocessableEntity, ServeError{Error: err.Error()}
+			}
+			s.save_settings()
+		}
+		si, err := s.get_setting_info(SETTING_STR)
+		if err != nil {
+			return http.StatusUnprocessableEntity, ServeError{Error: err.Error()}
+		}
+		idx, _ := strconv.Atoi(si.format_value())
+		return http.StatusOK, map[string]int{"index": idx}
+	})
+}
+
+// Browsers always send Origin; by default only pages served from the local
+// host may connect (and non-browser clients, which send no Origin)
+func origin_allowed(origin string, allowed []string) bool {
+	if origin == "" {
+		return true
+	}
+	if len(allowed) == 0 {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		switch u.Hostname() {
+		case "localhost", "127.0.0.1", "::1":
+			return true
+		}
+		return false
+	}
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// The -origin list
+func parse_origins(origins string) []string {
+	allowed := []string{}
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			allowed = append(allowed, o)
+		}
+	}
+	return allowed
+}
+
+// FC requests are checked, so that other web pages the user visits cannot
+// drive the FC: the Origin, and the X-Impload header, which a page cannot
+// send to another origin without a CORS preflight (which is not answered).
+// Simple requests (e.g. an <img> GET) may have no Origin.
+func (sv *Server) fc_route(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); !origin_allowed(origin, sv.origins) {
+			fmt.Fprintf(os.Stderr, "serve: rejected origin %s\n", origin)
+			write_error(w, http.StatusForbidden, "origin not allowed")
+			return
+		}
+		if r.Header.Get("X-Impload") == "" {
+			write_error(w, http.StatusForbidden, "X-Impload header required")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (sv *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
+		write_json(w, http.StatusOK, map[string]string{"version": GetVersion()})
+	})
+	mux.HandleFunc("/api/convert", sv.convert)
+	mux.HandleFunc("/api/validate", sv.validate)
+	mux.HandleFunc("/api/stats", sv.stats)
+	mux.HandleFunc("/api/fc/test", sv.fc_route(sv.fc_test))
+	mux.HandleFunc("/api/fc/upload", sv.fc_route(func(w http.ResponseWriter, r *http.Request) { sv.fc_upload(w, r, false) }))
+	mux.HandleFunc("/api/fc/store", sv.fc_route(func(w http.ResponseWriter, r *http.Request) { sv.fc_upload(w, r, true) }))
+	mux.HandleFunc("/api/fc/download", sv.fc_route(func(w http.ResponseWriter, r *http.Request) { sv.fc_download(w, r, false) }))
+	mux.HandleFunc("/api/fc/restore", sv.fc_route(func(w http.ResponseWriter, r *http.Request) { sv.fc_download(w, r, true) }))
+	mux.HandleFunc("/api/fc/multi", sv.fc_route(sv.fc_multi))
+	return mux
+}
+
+// serve [-listen [host]:port] [-origin list]
+func do_serve(laddr string, origins string) {
+	open_capture()
+	sv := &Server{origins: parse_origins(origins)}
+	fmt.Fprintf(os.Stderr, "Serving on %s\n", listen_addr(laddr))
+	log.Fatal(http.ListenAndServe(listen_addr(laddr), sv.routes()))
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	msp_COMMON_SETTING_INFO = 0x1007
+)
+
+const (
+	setting_UINT8 = iota
+	setting_INT8
+	setting_UINT16
+	setting_INT16
+	setting_UINT32
+	setting_FLOAT
+	setting_STRING
+)
+
+const (
+	setting_MODE_LOOKUP = 0x40
+	setting_TYPE_MASK   = 0x07
+	setting_MODE_MASK   = 0xc0
+)
+
+type SettingInfo struct {
+	Name     string
+	Pgn      uint16
+	Type     uint8
+	Section  uint8
+	Mode     uint8
+	Min      int32
+	Max      uint32
+	Index    uint16
+	Profile  uint8
+	Profiles uint8
+	Enums    []string
+	Value    []byte
+}
+
+type SettingValue struct {
+	Name  string `xml:"name,attr" json:"name"`
+	Value string `xml:"value,attr" json:"value"`
+}
+
+type SettingChange struct {
+	si   *SettingInfo
+	oval []byte
+	nval []byte
+}
+
+func nul_terminated(name string) []byte {
+	buf := make([]byte, len(name)+1)
+	copy(buf, name)
+	return buf
+}
+
+func next_cstring(b []byte) (string, []byte) {
+	n := bytes.IndexByte(b, 0)
+	if n == -1 {
+		return string(b), nil
+	}
+	return string(b[:n]), b[n+1:]
+}
+
+func (m *MSPSerial) get_setting_info(name string) (*SettingInfo, error) {
+	v := m.Wait_msp(msp_COMMON_SETTING_INFO, nul_terminated(name))
+	if !v.ok || v.len == 0 {
+		return nil, fmt.Errorf("unknown setting \"%s\"", name)
+	}
+	si := &SettingInfo{}
+	var b []byte
+	si.Name, b = next_cstring(v.data)
+	if len(b) < 17 {
+		return nil, fmt.Errorf("short setting info for \"%s\"", name)
+	}
+	si.Pgn = binary.LittleEndian.Uint16(b[0:2])
+	si.Type = b[2] & setting_TYPE_MASK
+	si.Section = b[3]
+	si.Mode = b[4] & setting_MODE_MASK
+	si.Min = int32(binary.LittleEndian.Uint32(b[5:9]))
+	si.Max = binary.LittleEndian.Uint32(b[9:13])
+	si.Index = binary.LittleEndian.Uint16(b[13:15])
+	si.Profile = b[15]
+	si.Profiles = b[16]
+	b = b[17:]
+	if si.Mode == setting_MODE_LOOKUP {
+		for j := int64(si.Min); j <= int64(si.Max); j++ {
+			var s string
+			s, b = next_cstring(b)
+			si.Enums = append(si.Enums, s)
+		}
+	}
+	si.Value = b
+	return si, nil
+}
+
+func (si *SettingInfo) type_name() string {
+	switch si.Type {
+	case setting_UINT8:
+		return "uint8"
+	case setting_INT8:
+		return "int8"
+	case setting_UINT16:
+		return "uint16"
+	case setting_INT16:
+		return "int16"
+	case setting_UINT32:
+		return "uint32"
+	case setting_FLOAT:
+		return "float"
+	case setting_STRING:
+		return "string"
+	default:
+		return "unknown"
+	}
+}
+
+func (si *SettingInfo) value_size() int {
+	switch si.Type {
+	case setting_UINT8, setting_INT8:
+		return 1
+	case setting_UINT16, setting_INT16:
+		return 2
+	case setting_UINT32, setting_FLOAT:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// Numeric value of a non-string setting
+func (si *SettingInfo) raw_value(b []byte) float64 {
+	if len(b) < si.value_size() {
+		return 0
+	}
+	switch si.Type {
+	case setting_UINT8:
+		return float64(b[0])
+	case setting_INT8:
+		return float64(int8(b[0]))
+	case setting_UINT16:
+		return float64(binary.LittleEndian.Uint16(b))
+	case setting_INT16:
+		return float64(int16(binary.LittleEndian.Uint16(b)))
+	case setting_UINT32:
+		return float64(binary.LittleEndian.Uint32(b))
+	case setting_FLOAT:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	}
+	return 0
+}
+
+func (si *SettingInfo) format_value() string {
+	if si.Type == setting_STRING {
+		s, _ := next_cstring(si.Value)
+		return s
+	}
+	v := si.raw_value(si.Value)
+	if si.Mode == setting_MODE_LOOKUP {
+		idx := int(v) - int(si.Min)
+		if idx >= 0 && idx < len(si.Enums) {
+			return si.Enums[idx]
+		}
+	}
+	if si.Type == setting_FLOAT {
+		return strconv.FormatFloat(v, 'f', -1, 32)
+	}
+	return strconv.FormatInt(int64(v), 10)
+}
+
+func (si *SettingInfo) range_str() string {
+	if si.Mode == setting_MODE_LOOKUP {
+		return strings.Join(si.Enums, ", ")
+	}
+	if si.Type == setting_STRING {
+		return fmt.Sprintf("max length %d", si.Max)
+	}
+	return fmt.Sprintf("%d .. %d", si.Min, si.Max)
+}
+
+// Encodes a textual value as the FC's binary representation, enforcing
+// the FC's range / enumeration
+func (si *SettingInfo) encode_value(str string) ([]byte, error) {
+	str = strings.TrimSpace(str)
+	if si.Type == setting_STRING {
+		if si.Max > 0 && uint32(len(str)) > si.Max {
+			return nil, fmt.Errorf("%s: string too long (max %d)", si.Name, si.Max)
+		}
+		return nul_terminated(str), nil
+	}
+
+	var fv float64
+	var err error
+	found := false
+	if si.Mode == setting_MODE_LOOKUP {
+		for j, e := range si.Enums {
+			if strings.EqualFold(e, str) {
+				fv = float64(int(si.Min) + j)
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		fv, err = strconv.ParseFloat(str, 64)
+		if err != nil {
+			if si.Mode == setting_MODE_LOOKUP {
+				return nil, fmt.Errorf("%s: invalid value \"%s\" (%s)", si.Name, str, si.range_str())
+			}
+			return nil, fmt.Errorf("%s: invalid value \"%s\"", si.Name, str)
+		}
+		if si.Type != setting_FLOAT && fv != math.Trunc(fv) {
+			return nil, fmt.Errorf("%s: integer required (%s)", si.Name, str)
+		}
+	}
+	if fv < float64(si.Min) || fv > float64(si.Max) {
+		return nil, fmt.Errorf("%s: value %s out of range (%s)", si.Name, str, si.range_str())
+	}
+
+	b := make([]byte, si.value_size())
+	switch si.Type {
+	case setting_UINT8:
+		b[0] = uint8(fv)
+	case setting_INT8:
+		b[0] = uint8(int8(fv))
+	case setting_UINT16:
+		binary.LittleEndian.PutUint16(b, uint16(fv))
+	case setting_INT16:
+		binary.LittleEndian.PutUint16(b, uint16(int16(fv)))
+	case setting_UINT32:
+		binary.LittleEndian.PutUint32(b, uint32(fv))
+	case setting_FLOAT:
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(fv)))
+	}
+	return b, nil
+}
+
+func (m *MSPSerial) write_setting(si *SettingInfo, b []byte) error {
+	buf := append(nul_terminated(si.Name), b...)
+	v := m.Wait_msp(msp_COMMON_SET_SETTING, buf)
+	if !v.ok {
+		return fmt.Errorf("FC rejected %s", si.Name)
+	}
+	si.Value = b
+	return nil
+}
+
+func (m *MSPSerial) set_setting(name string, value string) (*SettingInfo, error) {
+	si, err := m.get_setting_info(name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := si.encode_value(value)
+	if err != nil {
+		return nil, err
+	}
+	err = m.write_setting(si, b)
+	if err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+// Validates all settings against the FC before anything is changed;
+// returns only those settings that differ from the FC
+func (m *MSPSerial) prepare_settings(svs []SettingValue) ([]SettingChange, error) {
+	changes := []SettingChange{}
+	for _, sv := range svs {
+		si, err := m.get_setting_info(sv.Name)
+		if err != nil {
+			return nil, err
+		}
+		b, err := si.encode_value(sv.Value)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(b, si.Value) {
+			changes = append(changes, SettingChange{si: si, oval: si.Value, nval: b})
+		}
+	}
+	return changes, nil
+}
+
+func (m *MSPSerial) show_setting_changes(changes []SettingChange) {
+	for _, c := range changes {
+		si := *c.si
+		si.Value = c.oval
+		ostr := si.format_value()
+		si.Value = c.nval
+		m.printf("  %s: %s -> %s\n", si.Name, ostr, si.format_value())
+	}
+}
+
+func (m *MSPSerial) apply_settings(changes []SettingChange) error {
+	for _, c := range changes {
+		if err := m.write_setting(c.si, c.nval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MSPSerial) rollback_settings(changes []SettingChange) {
+	for _, c := range changes {
+		if err := m.write_setting(c.si, c.oval); err != nil {
+			m.printf("Rollback: %v\n", err)
+		}
+	}
+	m.printf("Rolled back %d setting(s)\n", len(changes))
+}
+
+// Settings in a sidecar override those of the same name in the mission
+func merge_settings(svs []SettingValue, extra []SettingValue) []SettingValue {
+	for _, e := range extra {
+		found := false
+		for j := range svs {
+			if svs[j].Name == e.Name {
+				svs[j].Value = e.Value
+				found = true
+				break
+			}
+		}
+		if !found {
+			svs = append(svs, e)
+		}
+	}
+	return svs
+}
+
+// A JSON sidecar is an object of setting names and values, e.g.
+// {"nav_wp_radius": 300, "nav_wp_mission_restart": "RESUME"}
+func read_settings_sidecar(path string) ([]SettingValue, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kv map[string]interface{}
+	if err = json.Unmarshal(dat, &kv); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(kv))
+	for k := range kv {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	svs := []SettingValue{}
+	for _, k := range names {
+		svs = append(svs, SettingValue{Name: k, Value: fmt.Sprint(kv[k])})
+	}
+	return svs, nil
+}
+
+func settings_sidecar_name(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".settings.json"
+}
+
+func (m *MSPSerial) save_settings() {
+	m.Wait_msp(msp_EEPROM_WRITE, nil)
+	m.printf("Saved settings\n")
+}
+
+// Parses "name=value", "name = value" and inav cli "set name = value"
+// lines; comments and other cli commands are ignored
+func parse_setting_lines(dat []byte) []SettingValue {
+	svs := []SettingValue{}
+	for _, ln := range strings.Split(string(dat), "\n") {
+		ln = strings.TrimSpace(ln)
+		if sv, ok := parse_setting_line(ln); ok {
+			svs = append(svs, sv)
+		}
+	}
+	return svs
+}
+
+func parse_setting_line(ln string) (SettingValue, bool) {
+	if len(ln) == 0 || ln[0] == '#' {
+		return SettingValue{}, false
+	}
+	if strings.HasPrefix(ln, "set ") {
+		ln = strings.TrimSpace(ln[4:])
+	}
+	parts := strings.SplitN(ln, "=", 2)
+	if len(parts) != 2 {
+		return SettingValue{}, false
+	}
+	name := strings.TrimSpace(parts[0])
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return SettingValue{}, false
+	}
+	return SettingValue{Name: name, Value: strings.TrimSpace(parts[1])}, true
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Maximum number of history lines kept
+const SHELL_HISTORY = 500
+
+var wp_actions = []string{"WAYPOINT", "POSHOLD_UNLIM", "POSHOLD_TIME", "RTH", "SET_POI", "JUMP", "SET_HEAD", "LAND"}
+
+type Shell struct {
+	s       *MSPSerial
+	mm      *MultiMission
+	history []string
+	hfile   string
+}
+
+// Returns the segment and index of WP n (1 based, over all segments)
+func (mm *MultiMission) locate_wp(n int) (int, int, bool) {
+	for j, ms := range mm.Segment {
+		if n >= 1 && n <= len(ms.MissionItems) {
+			return j, n - 1, true
+		}
+		n -= len(ms.MissionItems)
+	}
+	return 0, 0, false
+}
+
+// Adjusts JUMP targets (WP numbers) in segment j after inserting (delta 1)
+// or deleting (delta -1) the WP at index k. An inserted JUMP's own target
+// is as given.
+func (mm *MultiMission) fix_jumps(j int, k int, delta int16) {
+	mis := mm.Segment[j].MissionItems
+	wpno := int16(k + 1)
+	for i := range mis {
+		if mis[i].Action != "JUMP" || (delta > 0 && i == k) {
+			continue
+		}
+		switch {
+		case delta > 0 && mis[i].P1 >= wpno:
+			mis[i].P1++
+		case delta < 0 && mis[i].P1 > wpno:
+			mis[i].P1--
+		case delta < 0 && mis[i].P1 == wpno:
+			fmt.Fprintf(os.Stderr, "Warning: JUMP at segment %d, WP %d targeted the deleted WP\n", j+1, i+1)
+		}
+	}
+}
+
+// Inserts mi before WP n; n = WP count + 1 appends to the last segment
+func (mm *MultiMission) Insert_wp(n int, mi MissionItem) error {
+	if len(mm.Segment) == 0 {
+		mm.Segment = []MissionSegment{{}}
+	}
+	j, k, ok := mm.locate_wp(n)
+	if !ok {
+		if n != mm.wp_count()+1 {
+			return fmt.Errorf("invalid WP %d", n)
+		}
+		j = len(mm.Segment) - 1
+		k = len(mm.Segment[j].MissionItems)
+	}
+	mis := mm.Segment[j].MissionItems
+	mis = append(mis[:k], append([]MissionItem{mi}, mis[k:]...)...)
+	mm.Segment[j].MissionItems = mis
+	mm.fix_jumps(j, k, 1)
+	mm.Renumber_segments()
+	return nil
+}
+
+func (mm *MultiMission) Delete_wp(n int) error {
+	j, k, ok := mm.locate_wp(n)
+	if !ok {
+		return fmt.Errorf("invalid WP %d", n)
+	}
+	mis := mm.Segment[j].MissionItems
+	mm.Segment[j].MissionItems = append(mis[:k], mis[k+1:]...)
+	mm.fix_jumps(j, k, -1)
+	if len(mm.Segment[j].MissionItems) == 0 && len(mm.Segment) > 1 {
+		mm.Segment = append(mm.Segment[:j], mm.Segment[j+1:]...)
+	}
+	mm.Renumber_segments()
+	return nil
+}
+
+// Applies field=value changes (action, lat, lon, alt, p1, p2, p3)
+func (mi *MissionItem) Edit(changes []string) error {
+	for _, c := range changes {
+		parts := strings.SplitN(c, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("field=value expected (%s)", c)
+		}
+		f := strings.ToLower(parts[0])
+		v := parts[1]
+		var err error
+		var fv float64
+		var iv int64
+		switch f {
+		case "action":
+			v = strings.ToUpper(v)
+			found := false
+			for _, a := range wp_actions {
+				if a == v {
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("invalid action %s (%s)", v, strings.Join(wp_actions, ", "))
+			}
+			mi.Action = v
+		case "lat", "lon":
+			if fv, err = strconv.ParseFloat(v, 64); err == nil {
+				if f == "lat" {
+					mi.Lat = fv
+				} else {
+					mi.Lon = fv
+				}
+			}
+		case "alt":
+			if iv, err = strconv.ParseInt(v, 10, 32); err == nil {
+				mi.Alt = int32(iv)
+			}
+		case "p1", "p2", "p3":
+			if iv, err = strconv.ParseInt(v, 10, 16); err == nil {
+				switch f {
+				case "p1":
+					mi.P1 = int16(iv)
+				case "p2":
+					mi.P2 = int16(iv)
+				default:
+					mi.P3 = int16(iv)
+				}
+			}
+		default:
+			return fmt.Errorf("unknown field %s (action, lat, lon, alt, p1, p2, p3)", f)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value for %s (%s)", f, v)
+		}
+	}
+	return nil
+}
+
+func (mm *MultiMission) Show() {
+	n := 0
+	for j, ms := range mm.Segment {
+		if len(mm.Segment) > 1 {
+			fmt.Printf("Segment %d\n", j+1)
+		}
+		for _, mi := range ms.MissionItems {
+			n++
+			if mi.is_GeoPoint() {
+				fmt.Printf("%4d %-13s %11.7f %12.7f %5d %6d %6d %6d\n", n, mi.Action, mi.Lat, mi.Lon, mi.Alt, mi.P1, mi.P2, mi.P3)
+			} else {
+				fmt.Printf("%4d %-13s %11s %12s %5s %6d %6d %6d\n", n, mi.Action, "", "", "", mi.P1, mi.P2, mi.P3)
+			}
+		}
+		if has_fwapproach(ms.FWApproach) {
+			fa := ms.FWApproach
+			fmt.Printf("     FW approach %d/%d, %s, alt %d, land %d\n", fa.Dirn1, fa.Dirn2, fa.Dref, fa.Appalt, fa.Landalt)
+		}
+	}
+	if n == 0 {
+		fmt.Println("No mission")
+	}
+}
+
+// Opens the FC session if necessary
+func (sh *Shell) fc() *MSPSerial {
+	if sh.s == nil {
+		devdesc, err := find_device()
+		var s *MSPSerial
+		if err == nil {
+			open_capture()
+			s, err = NewMSPSerial(devdesc)
+		}
+		if err != nil {
+			panic(MSPError(err.Error()))
+		}
+		s.recoverable = true
+		sh.s = s
+		s.Init()
+	}
+	return sh.s
+}
+
+func (sh *Shell) mission() (*MultiMission, error) {
+	if sh.mm == nil || sh.mm.wp_count() == 0 {
+		return nil, fmt.Errorf("no mission (use load or download)")
+	}
+	return sh.mm, nil
+}
+
+func wp_arg(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WP number %s", s)
+	}
+	return n, nil
+}
+
+const shell_help = `Commands:
+  info                        FC identity and WP counts
+  load FILE                   read a mission file
+  write [FILE]                write the mission (-fmt format, default stdout)
+  show                        list the mission
+  edit N field=value ...      change WP N (action, lat, lon, alt, p1, p2, p3)
+  insert N [field=value ...]  insert a WP before WP N (N = count + 1 appends)
+  delete N                    delete WP N
+  upload | store              upload the mission (store also saves to EEPROM)
+  download | restore          download the mission (restore loads it from EEPROM first)
+  multi [N]                   get or set (and save) the multi-mission index
+  get NAME ...                get settings
+  set NAME=VALUE ...          set settings (saved with -save)
+  history                     list the command history (!N or !! repeats)
+  help                        this list
+  quit | exit                 leave the shell
+WP numbers run over all segments of a multi-mission.
+`
+
+// Runs one command; FC errors are reported and the session (also after using
+// the CLI) reopened by the next FC command
+func (sh *Shell) exec(args []string) (quit bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(MSPError); ok {
+				fmt.Fprintf(os.Stderr, "FC: %v\n", e)
+				if sh.s != nil {
+					sh.s.sd.Close()
+					sh.s = nil
+				}
+			} else {
+				panic(r)
+			}
+		}
+		if sh.s != nil && sh.s.cli.Load() { // the FC rebooted on leaving the CLI
+			sh.s.sd.Close()
+			sh.s = nil
+		}
+	}()
+	var err error
+	switch cmd := args[0]; cmd {
+	case "quit", "exit":
+		return true
+	case "help", "?":
+		fmt.Print(shell_help)
+	case "history":
+		for j, h := range sh.history {
+			fmt.Printf("%4d  %s\n", j+1, h)
+		}
+	case "info":
+		info := sh.fc().wp_info()
+		fmt.Printf("%s v%s %s (%s) API %s \"%s\"\n", info.Variant, info.Version, info.Board, info.Git, info.Api, info.Name)
+		fmt.Printf("Waypoints: %d of %d, valid %d\n", info.WpCount, info.WpMax, info.WpValid)
+	case "load":
+		if len(args) != 2 {
+			err = fmt.Errorf("load FILE")
+			break
+		}
+		mtype, m, rerr := Read_Mission_File(args[1])
+		if m == nil || rerr != nil {
+			err = fmt.Errorf("invalid input file %s", args[1])
+			break
+		}
+		sanitise_mission(m, mtype)
+		sh.mm = m
+		fmt.Printf("Loaded %s (%s), %d segments, %d WP\n", args[1], mtype, len(m.Segment), m.wp_count())
+	case "write":
+		var mm *MultiMission
+		if mm, err = sh.mission(); err == nil {
+			outf := "-"
+			if len(args) > 1 {
+				outf = args[1]
+			}
+			mm.Dump(*outfmt, outf)
+		}
+	case "show":
+		if sh.mm == nil {
+			err = fmt.Errorf("no mission (use load or download)")
+		} else {
+			sh.mm.Show()
+		}
+	case "edit":
+		var mm *MultiMission
+		var n int
+		if len(args) < 3 {
+			err = fmt.Errorf("edit N field=value ...")
+		} else if mm, err = sh.mission(); err == nil {
+			if n, err = wp_arg(args[1]); err == nil {
+				if j, k, ok := mm.locate_wp(n); !ok {
+					err = fmt.Errorf("invalid WP %d", n)
+				} else {
+					mi := mm.Segment[j].MissionItems[k]
+					if err = mi.Edit(args[2:]); err == nil {
+						mm.Segment[j].MissionItems[k] = mi
+					}
+				}
+			}
+		}
+	case "insert":
+		var n int
+		if len(args) < 2 {
+			err = fmt.Errorf("insert N [field=value ...]")
+		} else if n, err = wp_arg(args[1]); err == nil {
+			if sh.mm == nil {
+				sh.mm = NewMultiMission(nil)
+			}
+			mi := MissionItem{Action: "WAYPOINT", Alt: int32(*defalt)}
+			// New WPs start at the location of the previous (or next) WP
+			for _, p := range []int{n - 1, n} {
+				if j, k, ok := sh.mm.locate_wp(p); ok && sh.mm.Segment[j].MissionItems[k].is_GeoPoint() {
+					mi.Lat = sh.mm.Segment[j].MissionItems[k].Lat
+					mi.Lon = sh.mm.Segment[j].MissionItems[k].Lon
+					break
+				}
+			}
+			if err = mi.Edit(args[2:]); err == nil {
+				err = sh.mm.Insert_wp(n, mi)
+			}
+		}
+	case "delete":
+		var mm *MultiMission
+		var n int
+		if len(args) != 2 {
+			err = fmt.Errorf("delete N")
+		} else if mm, err = sh.mission(); err == nil {
+			if n, err = wp_arg(args[1]); err == nil {
+				err = mm.Delete_wp(n)
+			}
+		}
+	case "upload", "store":
+		var mm *MultiMission
+		if mm, err = sh.mission(); err == nil {
+			// The mission was sanitised when loaded
+			err = sh.fc().upload_mission(mm, "shell", cmd == "store")
+		}
+	case "download", "restore":
+		sh.mm = sh.fc().download(cmd == "restore")
+		fmt.Printf("Downloaded %d segments, %d WP\n", len(sh.mm.Segment), sh.mm.wp_count())
+	case "multi":
+		s := sh.fc()
+		if len(args) > 1 {
+			n, cerr := strconv.Atoi(args[1])
+			if cerr != nil || n < 0 || n > MAX_SEGMENTS {
+				err = fmt.Errorf("invalid index %s (0-%d)", args[1], MAX_SEGMENTS)
+				break
+			}
+			if _, err = s.set_setting(SETTING_STR, args[1]); err != nil {
+				break
+			}
+			s.save_settings()
+		}
+		s.get_multi_index()
+	case "get":
+		s := sh.fc()
+		for _, name := range args[1:] {
+			if si, gerr := s.get_setting_info(name); gerr != nil {
+				fmt.Fprintln(os.Stderr, gerr)
+			} else {
+				fmt.Printf("set %s = %s\n", si.Name, si.format_value())
+			}
+		}
+	case "set":
+		s := sh.fc()
+		svs := parse_setting_lines([]byte(strings.Join(args[1:], "\n")))
+		if len(svs) == 0 {
+			err = fmt.Errorf("set NAME=VALUE ...")
+			break
+		}
+		for _, sv := range svs {
+			if si, serr := s.set_setting(sv.Name, sv.Value); serr != nil {
+				fmt.Fprintln(os.Stderr, serr)
+			} else {
+				fmt.Printf("set %s = %s\n", si.Name, si.format_value())
+			}
+		}
+		if *save {
+			s.save_settings()
+		}
+	default:
+		err = fmt.Errorf("unknown command %s (try help)", cmd)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return false
+}
+
+// Expands !! and !N history references
+func (sh *Shell) expand(line string) (string, error) {
+	if !strings.HasPrefix(line, "!") {
+		return line, nil
+	}
+	n := len(sh.history)
+	if line != "!!" {
+		var err error
+		if n, err = strconv.Atoi(line[1:]); err != nil {
+			return "", fmt.Errorf("invalid history reference %s", line)
+		}
+	}
+	if n < 1 || n > len(sh.history) {
+		return "", fmt.Errorf("no history entry %s", line)
+	}
+	fmt.Println(sh.history[n-1])
+	return sh.history[n-1], nil
+}
+
+func (sh *Shell) load_history() {
+	if dir, err := os.UserConfigDir(); err == nil {
+		sh.hfile = filepath.Join(dir, "impload", "shell_history")
+		if dat, err := os.ReadFile(sh.hfile); err == nil {
+			for _, l := range strings.Split(string(dat), "\n") {
+				if l = strings.TrimSpace(l); l != "" {
+					sh.history = append(sh.history, l)
+				}
+			}
+		}
+	}
+}
+
+func (sh *Shell) save_history() {
+	if sh.hfile == "" {
+		return
+	}
+	if n := len(sh.history); n > SHELL_HISTORY {
+		sh.history = sh.history[n-SHELL_HISTORY:]
+	}
+	os.MkdirAll(filepath.Dir(sh.hfile), 0755)
+	os.WriteFile(sh.hfile, []byte(strings.Join(sh.history, "\n")+"\n"), 0644)
+}
+
+func do_shell() {
+	sh := &Shell{}
+	sh.load_history()
+	defer sh.save_history()
+	interactive := false
+	if st, err := os.Stdin.Stat(); err == nil {
+		interactive = st.Mode()&os.ModeCharDevice != 0
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		if interactive {
+			fmt.Fprint(os.Stderr, "impload> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line, err := sh.expand(line)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		sh.history = append(sh.history, line)
+		if sh.exec(strings.Fields(line)) {
+			break
+		}
+	}
+}
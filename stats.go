@@ -0,0 +1,77 @@
+package main
+
+import (
+	"geo"
+)
+
+type SegmentStats struct {
+	Segment   int     `json:"segment"`
+	Waypoints int     `json:"waypoints"`
+	Distance  float64 `json:"distance"`
+	MinAlt    int32   `json:"min_alt"`
+	MaxAlt    int32   `json:"max_alt"`
+	LatMin    float64 `json:"lat_min"`
+	LatMax    float64 `json:"lat_max"`
+	LonMin    float64 `json:"lon_min"`
+	LonMax    float64 `json:"lon_max"`
+	Land      bool    `json:"land"`
+	RTH       bool    `json:"rth"`
+	Approach  bool    `json:"fwapproach"`
+}
+
+// Per segment statistics; distance (metres) is the sum of the legs between
+// geographic WPs in mission order (JUMPs are not followed)
+func (mm *MultiMission) Stats() []SegmentStats {
+	stats := []SegmentStats{}
+	for j, ms := range mm.Segment {
+		st := SegmentStats{Segment: j + 1, Waypoints: len(ms.MissionItems)}
+		bbox := BBox{-999, 999, -999, 999}
+		var last *MissionItem
+		ngeo := 0
+		for k := range ms.MissionItems {
+			mi := &ms.MissionItems[k]
+			switch mi.Action {
+			case "RTH":
+				st.RTH = true
+				if mi.P1 != 0 {
+					st.Land = true
+				}
+			case "LAND":
+				st.Land = true
+			}
+			if !mi.is_GeoPoint() {
+				continue
+			}
+			if ngeo == 0 || mi.Alt < st.MinAlt {
+				st.MinAlt = mi.Alt
+			}
+			if ngeo == 0 || mi.Alt > st.MaxAlt {
+				st.MaxAlt = mi.Alt
+			}
+			ngeo++
+			if mi.Lat > bbox.lamax {
+				bbox.lamax = mi.Lat
+			}
+			if mi.Lat < bbox.lamin {
+				bbox.lamin = mi.Lat
+			}
+			if mi.Lon > bbox.lomax {
+				bbox.lomax = mi.Lon
+			}
+			if mi.Lon < bbox.lomin {
+				bbox.lomin = mi.Lon
+			}
+			if last != nil {
+				_, d := geo.Csedist(last.Lat, last.Lon, mi.Lat, mi.Lon)
+				st.Distance += d * 1852.0
+			}
+			last = mi
+		}
+		if ngeo > 0 {
+			st.LatMin, st.LatMax, st.LonMin, st.LonMax = bbox.lamin, bbox.lamax, bbox.lomin, bbox.lomax
+		}
+		st.Approach = has_fwapproach(ms.FWApproach)
+		stats = append(stats, st)
+	}
+	return stats
+}
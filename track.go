@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A recorded position; alt is AMSL, or relative to home if the source is
+type TrackPoint struct {
+	lat float64
+	lon float64
+	alt float64
+}
+
+// Points below this (relative) altitude at the start and end of a track are
+// the take off and landing, which are not flown as WPs
+const TRACK_MIN_ALT = 5.0
+
+// Perpendicular distance (m) of p from the segment a-b, in 3D
+func track_offset(p, a, b TrackPoint) float64 {
+	kx := math.Cos(a.lat*math.Pi/180.0) * 60 * 1852
+	ky := 60 * 1852.0
+	bx, by, bz := (b.lon-a.lon)*kx, (b.lat-a.lat)*ky, b.alt-a.alt
+	px, py, pz := (p.lon-a.lon)*kx, (p.lat-a.lat)*ky, p.alt-a.alt
+	l2 := bx*bx + by*by + bz*bz
+	t := 0.0
+	if l2 > 0 {
+		t = (px*bx + py*by + pz*bz) / l2
+		if t < 0 {
+			t = 0
+		} else if t > 1 {
+			t = 1
+		}
+	}
+	dx, dy, dz := px-t*bx, py-t*by, pz-t*bz
+	return math.Sqrt(dx*dx + dy*dy + dz*dz)
+}
+
+// Douglas-Peucker simplification; returns the indices of the points kept
+func simplify_track(pts []TrackPoint, tol float64) []int {
+	keep := make([]bool, len(pts))
+	keep[0] = true
+	keep[len(pts)-1] = true
+	type span struct{ i, j int }
+	stack := []span{{0, len(pts) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		dmax, k := 0.0, -1
+		for n := s.i + 1; n < s.j; n++ {
+			if d := track_offset(pts[n], pts[s.i], pts[s.j]); d > dmax {
+				dmax, k = d, n
+			}
+		}
+		if k != -1 && dmax > tol {
+			keep[k] = true
+			stack = append(stack, span{s.i, k}, span{k, s.j})
+		}
+	}
+	idx := []int{}
+	for j, k := range keep {
+		if k {
+			idx = append(idx, j)
+		}
+	}
+	return idx
+}
+
+// Converts a flown track to a mission: altitudes relative to the first point
+// (unless already relative), take off and landing trimmed, and the path
+// simplified to the -simplify tolerance, which is increased if the mission
+// would not fit in the WP limit (leaving room for an RTH).
+func track_mission(src string, pts []TrackPoint, relative bool) *MultiMission {
+	if len(pts) < 2 {
+		fmt.Fprintf(os.Stderr, "%s: no track\n", src)
+		return nil
+	}
+	home := pts[0]
+	if !relative {
+		for j := range pts {
+			pts[j].alt -= home.alt
+		}
+	}
+	i, j := 0, len(pts)-1
+	for i < j && pts[i].alt < TRACK_MIN_ALT {
+		i++
+	}
+	for j > i && pts[j].alt < TRACK_MIN_ALT {
+		j--
+	}
+	if j-i < 1 {
+		fmt.Fprintf(os.Stderr, "%s: no track above %.0fm\n", src, TRACK_MIN_ALT)
+		return nil
+	}
+	pts = pts[i : j+1]
+
+	tol := *simplify
+	if tol <= 0 {
+		tol = 1
+	}
+	idx := simplify_track(pts, tol)
+	fitted := false
+	for len(idx) > DEFAULT_MAX_WP-1 {
+		tol *= 1.5
+		idx = simplify_track(pts, tol)
+		fitted = true
+	}
+	if fitted {
+		fmt.Fprintf(os.Stderr, "%s: tolerance increased to %.1fm to fit %d WPs\n", src, tol, DEFAULT_MAX_WP-1)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d points simplified to %d WPs\n", src, len(pts), len(idx))
+	mis := []MissionItem{}
+	for n, k := range idx {
+		mis = append(mis, MissionItem{No: n + 1, Action: "WAYPOINT", Lat: pts[k].lat, Lon: pts[k].lon,
+			Alt: int32(math.Round(pts[k].alt))})
+	}
+	mm := NewMultiMission(mis)
+	mm.Segment[0].Metadata.Homey = home.lat
+	mm.Segment[0].Metadata.Homex = home.lon
+	return mm
+}
+
+func is_blackbox_csv(dat []byte) bool {
+	ln, _, _ := bytes.Cut(dat, []byte("\n"))
+	return bytes.HasPrefix(ln, []byte("loopIteration,")) ||
+		(bytes.HasPrefix(ln, []byte("time (us),")) && bytes.Contains(ln, []byte("GPS_coord[0]")))
+}
+
+// blackbox_decode CSV, either the main log decoded with --merge-gps or the
+// .gps.csv. The altitude is navPos[2] (relative to home) if logged,
+// otherwise the GPS altitude.
+func read_blackbox_csv(dat []byte) *MultiMission {
+	r := csv.NewReader(bytes.NewReader(dat))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.ReuseRecord = true
+	hdr, err := r.Read()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Blackbox error: %v\n", err)
+		return nil
+	}
+	cols := map[string]int{}
+	for j, h := range hdr {
+		cols[strings.TrimSpace(h)] = j
+	}
+	ilat, ok1 := cols["GPS_coord[0]"]
+	ilon, ok2 := cols["GPS_coord[1]"]
+	if !ok1 || !ok2 {
+		fmt.Fprintln(os.Stderr, "Blackbox: no GPS data (decode with --merge-gps)")
+		return nil
+	}
+	ialt, relative := cols["navPos[2]"]
+	if !relative {
+		ialt = cols["GPS_altitude"]
+	}
+	ifix, hasfix := cols["GPS_fixType"]
+	value := func(rec []string, j int) float64 {
+		if j < len(rec) {
+			v, _ := strconv.ParseFloat(rec[j], 64)
+			return v
+		}
+		return 0
+	}
+	pts := []TrackPoint{}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			continue
+		}
+		if hasfix && value(rec, ifix) < 2 { // no 3D fix
+			continue
+		}
+		p := TrackPoint{lat: value(rec, ilat), lon: value(rec, ilon), alt: value(rec, ialt)}
+		if p.lat == 0 && p.lon == 0 {
+			continue
+		}
+		if relative {
+			p.alt /= 100
+		}
+		if n := len(pts); n > 0 && pts[n-1] == p {
+			continue
+		}
+		pts = append(pts, p)
+	}
+	return track_mission("Blackbox", pts, relative)
+}
+
+func is_igc(dat []byte) bool {
+	return len(dat) > 0 && dat[0] == 'A' && bytes.Contains(dat, []byte("\nHF"))
+}
+
+// IGC (glider logger) B records: BHHMMSSDDMMmmmNDDDMMmmmEVPPPPPGGGGG. The
+// pressure altitude is used if recorded, otherwise the GNSS altitude.
+func read_igc(dat []byte) *MultiMission {
+	pts := []TrackPoint{}
+	for _, ln := range strings.Split(string(dat), "\n") {
+		ln = strings.TrimRight(ln, "\r")
+		if len(ln) < 35 || ln[0] != 'B' {
+			continue
+		}
+		lat := igc_coord(ln[7:9], ln[9:14], ln[14])
+		lon := igc_coord(ln[15:18], ln[18:23], ln[23])
+		palt, _ := strconv.Atoi(ln[25:30])
+		galt, _ := strconv.Atoi(ln[30:35])
+		alt := palt
+		if alt == 0 {
+			alt = galt
+		}
+		if lat == 0 && lon == 0 {
+			continue
+		}
+		pts = append(pts, TrackPoint{lat, lon, float64(alt)})
+	}
+	return track_mission("IGC", pts, false)
+}
+
+// Degrees, minutes * 1000, hemisphere
+func igc_coord(deg, mins string, hemi byte) float64 {
+	d, _ := strconv.Atoi(deg)
+	m, _ := strconv.Atoi(mins)
+	v := float64(d) + float64(m)/60000.0
+	if hemi == 'S' || hemi == 'W' {
+		v = -v
+	}
+	return v
+}
+
+func is_nmea(dat []byte) bool {
+	return bytes.HasPrefix(dat, []byte("$")) &&
+		(bytes.Contains(dat, []byte("GGA,")) || bytes.Contains(dat, []byte("RMC,")))
+}
+
+// Checks the checksum (if any) and returns the fields of a sentence
+func nmea_fields(ln string) ([]string, bool) {
+	ln = strings.TrimSpace(ln)
+	if !strings.HasPrefix(ln, "$") {
+		return nil, false
+	}
+	body := ln[1:]
+	if j := strings.LastIndexByte(body, '*'); j != -1 {
+		sum, err := strconv.ParseUint(body[j+1:], 16, 8)
+		if err != nil {
+			return nil, false
+		}
+		body = body[:j]
+		cs := byte(0)
+		for k := 0; k < len(body); k++ {
+			cs ^= body[k]
+		}
+		if cs != byte(sum) {
+			return nil, false
+		}
+	}
+	return strings.Split(body, ","), true
+}
+
+// ddmm.mmmm, hemisphere
+func nmea_coord(v, hemi string) float64 {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0
+	}
+	d := math.Floor(f / 100)
+	f = d + (f-d*100)/60
+	if hemi == "S" || hemi == "W" {
+		f = -f
+	}
+	return f
+}
+
+// NMEA GGA (with altitude) or, if there are none, RMC sentences; a log of
+// RMC only is flown at the default altitude (-a)
+func read_nmea(dat []byte) *MultiMission {
+	gga := []TrackPoint{}
+	rmc := []TrackPoint{}
+	for _, ln := range strings.Split(string(dat), "\n") {
+		f, ok := nmea_fields(ln)
+		if !ok || len(f[0]) != 5 {
+			continue
+		}
+		switch f[0][2:] {
+		case "GGA":
+			if len(f) < 10 || f[6] == "" || f[6] == "0" {
+				continue
+			}
+			alt, _ := strconv.ParseFloat(f[9], 64)
+			gga = append(gga, TrackPoint{nmea_coord(f[2], f[3]), nmea_coord(f[4], f[5]), alt})
+		case "RMC":
+			if len(f) < 7 || f[2] != "A" {
+				continue
+			}
+			rmc = append(rmc, TrackPoint{nmea_coord(f[3], f[4]), nmea_coord(f[5], f[6]), float64(*defalt)})
+		}
+	}
+	if len(gga) > 0 {
+		return track_mission("NMEA", gga, false)
+	}
+	return track_mission("NMEA", rmc, true)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Polling interval; a change is acted on once the file has been stable for
+// one interval, so partially written files are not read
+const WATCH_INTERVAL = 500 * time.Millisecond
+
+type Watcher struct {
+	inf   string
+	outf  string
+	store bool
+	s     *MSPSerial
+	last  *MultiMission
+}
+
+// Opens the FC session if necessary; errors are reported and the session
+// retried on the next change
+func (w *Watcher) fc() *MSPSerial {
+	if w.s == nil {
+		devdesc, err := find_device()
+		var s *MSPSerial
+		if err == nil {
+			s, err = NewMSPSerial(devdesc)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FC: %v\n", err)
+			return nil
+		}
+		s.recoverable = true
+		w.s = s
+		s.Init()
+	}
+	return w.s
+}
+
+func (w *Watcher) upload(m *MultiMission, mtype string) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(MSPError); ok {
+				fmt.Fprintf(os.Stderr, "FC: %v\n", e)
+				if w.s != nil {
+					w.s.sd.Close()
+					w.s = nil
+				}
+			} else {
+				panic(r)
+			}
+		}
+		if w.s != nil && w.s.cli.Load() { // the FC rebooted on leaving the CLI
+			w.s.sd.Close()
+			w.s = nil
+		}
+	}()
+	if s := w.fc(); s != nil {
+		if err := s.upload_mission(m, mtype, w.store); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// Re-reads, validates and converts / uploads the mission
+func (w *Watcher) update() {
+	mtype, m, err := Read_Mission_File(w.inf)
+	if m == nil || err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid mission file (%s)\n", w.inf, mtype)
+		return
+	}
+	if problems := m.Validate(); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "  %s\n", p)
+		}
+		if !m.is_valid() {
+			fmt.Fprintln(os.Stderr, "Not updated")
+			return
+		}
+	}
+	if w.outf != "" {
+		sanitise_mission(m, mtype)
+		m.Dump(*outfmt, w.outf, w.inf, mtype)
+		fmt.Fprintf(os.Stderr, "Converted %d segments, %d WP -> %s\n", len(m.Segment), m.wp_count(), w.outf)
+	} else {
+		// upload_mission sanitises (and rebases) the mission
+		w.upload(m, mtype)
+	}
+	if w.last != nil {
+		d := Diff_missions(w.last, m, true)
+		if len(d.lines) == 0 {
+			fmt.Fprintln(os.Stderr, "No changes")
+		}
+		for _, l := range d.lines {
+			fmt.Println(l)
+		}
+	}
+	w.last = m
+}
+
+// watch [-o outfile | -store] FILE
+func do_watch(inf string, outf string, store bool) {
+	if inf == "-" || (outf != "" && store) {
+		log.Println("watch: a file, and only one of -o and -store, required")
+		os.Exit(EXIT_USAGE)
+	}
+	w := &Watcher{inf: inf, outf: outf, store: store}
+	var mtime time.Time
+	var size int64 = -1
+	pending := true
+	for {
+		if st, err := os.Stat(w.inf); err == nil {
+			if !st.ModTime().Equal(mtime) || st.Size() != size {
+				mtime = st.ModTime()
+				size = st.Size()
+				pending = true
+			} else if pending {
+				pending = false
+				fmt.Fprintf(os.Stderr, "%s: %s\n", time.Now().Format("15:04:05"), w.inf)
+				w.update()
+			}
+		}
+		time.Sleep(WATCH_INTERVAL)
+	}
+}
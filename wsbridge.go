@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Minimal (RFC 6455) WebSocket server, sufficient to carry raw MSP frames to
+// and from a browser as binary messages.
+
+const ws_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Maximum size of a received WebSocket frame
+const ws_MAX_FRAME = 64 * 1024
+
+const (
+	ws_CONT   = 0
+	ws_TEXT   = 1
+	ws_BINARY = 2
+	ws_CLOSE  = 8
+	ws_PING   = 9
+	ws_PONG   = 10
+)
+
+// A SerDev over a WebSocket connection; the payloads of received data frames
+// are returned by Read, Write sends a binary frame
+type WSConn struct {
+	conn  net.Conn
+	br    *bufio.Reader
+	wmu   sync.Mutex
+	rxbuf []byte
+}
+
+func (ws *WSConn) write_frame(op byte, buf []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	hdr := []byte{0x80 | op, 0}
+	switch n := len(buf); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n < 65536:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	_, err := ws.conn.Write(append(hdr, buf...))
+	return err
+}
+
+// Reads one frame; client frames must be masked
+func (ws *WSConn) read_frame() (bool, byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(ws.br, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := hdr[0]&0x80 != 0
+	op := hdr[0] & 0xf
+	if hdr[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked client frame")
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(ws.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(ws.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > ws_MAX_FRAME {
+		return false, 0, nil, fmt.Errorf("frame too large (%d)", n)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(ws.br, buf); err != nil {
+		return false, 0, nil, err
+	}
+	for j := range buf {
+		buf[j] ^= mask[j&3]
+	}
+	return fin, op, buf, nil
+}
+
+func (ws *WSConn) Read(buf []byte) (int, error) {
+	for len(ws.rxbuf) == 0 {
+		_, op, dat, err := ws.read_frame()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case ws_CONT, ws_TEXT, ws_BINARY:
+			// MSP is a byte stream, so message boundaries are not significant
+			ws.rxbuf = dat
+		case ws_PING:
+			ws.write_frame(ws_PONG, dat)
+		case ws_CLOSE:
+			ws.write_frame(ws_CLOSE, nil)
+			return 0, io.EOF
+		}
+	}
+	n := copy(buf, ws.rxbuf)
+	ws.rxbuf = ws.rxbuf[n:]
+	return n, nil
+}
+
+func (ws *WSConn) Write(buf []byte) (int, error) {
+	if err := ws.write_frame(ws_BINARY, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (ws *WSConn) Close() error {
+	return ws.conn.Close()
+}
+
+func ws_accept_key(key string) string {
+	h := sha1.Sum([]byte(key + ws_GUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func header_has(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Completes the WebSocket handshake and takes over the connection
+func ws_upgrade(w http.ResponseWriter, r *http.Request) (*WSConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || !header_has(r.Header, "Connection", "upgrade") ||
+		!header_has(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", ws_accept_key(key))
+	if err = brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WSConn{conn: conn, br: brw.Reader}, nil
+}
+
+// wsbridge [-listen [host]:port] [-origin list]
+func do_wsbridge(laddr string, origins string) {
+	allowed := parse_origins(origins)
+	devdesc := check_device()
+	open_capture()
+
+	reqs := make(chan ProxyRequest)
+	go run_proxy(devdesc, reqs)
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if !origin_allowed(origin, allowed) {
+			fmt.Fprintf(os.Stderr, "WS: rejected origin %s\n", origin)
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		ws, err := ws_upgrade(w, r)
+		if err != nil {
+			if *verbose {
+				fmt.Fprintf(os.Stderr, "WS: %s: %v\n", r.RemoteAddr, err)
+			}
+			return
+		}
+		proxy_client(ws, r.RemoteAddr, reqs)
+	})
+	fmt.Fprintf(os.Stderr, "WS bridge: listening on ws://%s/\n", listen_addr(laddr))
+	log.Fatal(http.ListenAndServe(listen_addr(laddr), nil))
+}